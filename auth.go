@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The local API controls keys and which server the client trusts, so
+// every request must present the per-install bearer token.  The token is
+// generated on first start and is only readable by the owner of the data
+// directory, which is what the agent runs as.
+
+const apiTokenFile = "api.token"
+
+var (
+	apiToken     string
+	apiTokenLock sync.Mutex
+)
+
+// PeerCred identifies the local process on the other end of the Unix socket
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+type peerCredKey struct{}
+
+// PeerCredentials returns the caller's credentials if the request came in
+// over the Unix socket
+func PeerCredentials(req *http.Request) *PeerCred {
+	cred, _ := req.Context().Value(peerCredKey{}).(*PeerCred)
+	return cred
+}
+
+// PeerAuthorized returns true if a local user may change state through
+// the socket, such as starting and stopping the service: root, the user
+// we run as, or a member of cfg.SocketGroup
+func PeerAuthorized(cred *PeerCred) bool {
+	return cred.Uid == 0 || int(cred.Uid) == os.Getuid() || peerInGroup(cred, cfg.SocketGroup)
+}
+
+// PeerAdmin returns true if a local user may read or change keys and
+// configuration through the socket: root, the user we run as, or a member
+// of cfg.SocketAdminGroup if one is configured
+func PeerAdmin(cred *PeerCred) bool {
+	return cred.Uid == 0 || int(cred.Uid) == os.Getuid() || peerInGroup(cred, cfg.SocketAdminGroup)
+}
+
+// peerInGroup returns true if the group is the caller's primary group or
+// one of its supplementary groups
+func peerInGroup(cred *PeerCred, name string) bool {
+
+	if name == "" {
+		return false
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return false
+	}
+	if group.Gid == strconv.FormatUint(uint64(cred.Gid), 10) {
+		return true
+	}
+
+	u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+	if err != nil {
+		return false
+	}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, gid := range groups {
+		if gid == group.Gid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// socketAdminPaths need PeerAdmin whatever the method
+var socketAdminPaths = []string{"/keys/", "/config/"}
+
+// socketSensitivePaths can't be read by every user who can open the socket
+var socketSensitivePaths = []string{"/dns/log"}
+
+// socketAdmin returns true if a request needs PeerAdmin
+func socketAdmin(req *http.Request) bool {
+	for _, path := range socketAdminPaths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// socketSensitive returns true if a request needs PeerAuthorized
+func socketSensitive(req *http.Request) bool {
+	if req.Method != "GET" {
+		return true
+	}
+	for _, path := range socketSensitivePaths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAPIToken reads the token for the local API, creating it if necessary
+func LoadAPIToken() (string, error) {
+	apiTokenLock.Lock()
+	defer apiTokenLock.Unlock()
+
+	if apiToken != "" {
+		return apiToken, nil
+	}
+
+	path := GetDataPath() + apiTokenFile
+
+	data, err := ReadFileSafe(path, nil)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		apiToken = strings.TrimSpace(string(data))
+		return apiToken, nil
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	err = WriteFileAtomic(path, []byte(token+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("Created local API token %s", path)
+	apiToken = token
+
+	return apiToken, nil
+}
+
+// AllowedOrigin returns true if a browser page from origin may call the API
+func AllowedOrigin(origin string) bool {
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+
+	for _, allowed := range cfg.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize wraps a handler with the CORS and bearer token checks
+func authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		origin := req.Header.Get("Origin")
+		if origin != "" {
+			if !AllowedOrigin(origin) {
+				log.Errorf("Rejected %s %s from origin %s", req.Method, req.URL.Path, origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Add("Vary", "Origin")
+		}
+
+		// Preflight requests never carry credentials
+		if req.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Requests over the Unix socket are identified by the kernel rather
+		// than by token.  Anyone who can open the socket may read status,
+		// changes and the query log are limited to PeerAuthorized users,
+		// and keys and configuration to PeerAdmin users.
+		if cred := PeerCredentials(req); cred != nil {
+			if (socketAdmin(req) && !PeerAdmin(cred)) || (socketSensitive(req) && !PeerAuthorized(cred)) {
+				log.Errorf("Unauthorized %s %s from uid %d pid %d", req.Method, req.URL.Path, cred.Uid, cred.Pid)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			handler(w, req)
+			return
+		}
+
+		token, err := LoadAPIToken()
+		if err != nil {
+			log.Errorf("Error loading API token: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		presented := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			log.Errorf("Unauthorized %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nettica"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, req)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backoff spaces out calls to a control plane that is failing.  Each
+// consecutive failure doubles the delay up to a maximum, and the delay is
+// jittered so a fleet of clients doesn't retry in lockstep after an
+// incident.  A Retry-After from the server is honored if it is longer.
+type Backoff struct {
+	Name string
+
+	mu        sync.Mutex
+	failures  int
+	delay     time.Duration
+	until     time.Time
+	lastError string
+}
+
+// BackoffStatus is the read-only view of a Backoff for the local API
+type BackoffStatus struct {
+	Failures  int        `json:"failures"`
+	Delay     string     `json:"delay,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+var errBackoff = errors.New("backing off")
+
+// Failure records a failed call and schedules the next attempt
+func (b *Backoff) Failure(err error, retryAfter time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if err != nil {
+		b.lastError = err.Error()
+	}
+
+	delay := cfg.BackoffBase
+	for i := 1; i < b.failures && delay < cfg.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.BackoffMax {
+		delay = cfg.BackoffMax
+	}
+
+	// Equal jitter: somewhere between half and all of the delay
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+	}
+
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+
+	b.delay = delay
+	b.until = time.Now().Add(delay)
+
+	log.Warnf("Backoff: %s has failed %d times, next attempt in %v (%s)", b.Name, b.failures, delay.Round(time.Second), b.lastError)
+
+	return delay
+}
+
+// Success clears the backoff
+func (b *Backoff) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures > 0 {
+		log.Infof("Backoff: %s recovered after %d failures", b.Name, b.failures)
+	}
+
+	b.failures = 0
+	b.delay = 0
+	b.until = time.Time{}
+	b.lastError = ""
+}
+
+// Remaining returns how long until the next attempt is allowed
+func (b *Backoff) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.until.IsZero() {
+		return 0
+	}
+
+	remaining := time.Until(b.until)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Status returns a copy of the current state
+func (b *Backoff) Status() BackoffStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BackoffStatus{
+		Failures:  b.failures,
+		LastError: b.lastError,
+	}
+	if b.failures > 0 {
+		until := b.until
+		status.Until = &until
+		status.Delay = b.delay.Round(time.Second).String()
+	}
+
+	return status
+}
+
+// Response records the outcome of a completed request.  Rate limiting and
+// server errors count as failures, anything else means the server is up.
+func (b *Backoff) Response(resp *http.Response) {
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		b.Failure(errors.New(resp.Status), RetryAfter(resp))
+		return
+	}
+
+	b.Success()
+}
+
+// RetryAfter parses the Retry-After header, which is either a number of
+// seconds or an HTTP date
+func RetryAfter(resp *http.Response) time.Duration {
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+
+	return 0
+}
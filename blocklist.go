@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNS filtering.
+//
+// Blocklists and allowlists are local files in any of these formats:
+//
+//	0.0.0.0 ads.example.com          hosts file, the name is blocked
+//	ads.example.com                  one name per line
+//	||ads.example.com^               AdGuard, the name and everything below it
+//	*.ads.example.com                the same as ||ads.example.com^
+//	@@||cdn.example.com^             AdGuard exception, never blocked
+//
+// Lines starting with # or ! are comments.  Every name in an allowlist is
+// an exception.  The files are reloaded when they change.
+
+const blocklistCheckInterval = 10 * time.Second
+
+// BlockModes
+const (
+	BlockNXDomain = "nxdomain" // answer NXDOMAIN
+	BlockNull     = "null"     // answer 0.0.0.0 or ::
+)
+
+type blocklistFile struct {
+	path    string
+	allow   bool
+	modTime time.Time
+	size    int64
+	entries int
+}
+
+// BlocklistFileStatus is the read-only view of a list for the local API
+type BlocklistFileStatus struct {
+	Path    string    `json:"path"`
+	Allow   bool      `json:"allow"`
+	Loaded  time.Time `json:"loaded"`
+	Entries int       `json:"entries"`
+}
+
+// Blocklist holds the names loaded from the block and allow lists
+type Blocklist struct {
+	mu          sync.RWMutex
+	files       []*blocklistFile
+	exact       map[string]bool
+	suffix      map[string]bool
+	allowExact  map[string]bool
+	allowSuffix map[string]bool
+}
+
+var (
+	blocklist     = &Blocklist{}
+	blocklistOnce sync.Once
+)
+
+// StartBlocklists loads the configured lists and reloads them when they
+// change.  It does not return unless there are no lists.
+func StartBlocklists() {
+
+	blocklist.mu.Lock()
+	for _, path := range cfg.DNSBlocklists {
+		blocklist.files = append(blocklist.files, &blocklistFile{path: path})
+	}
+	for _, path := range cfg.DNSAllowlists {
+		blocklist.files = append(blocklist.files, &blocklistFile{path: path, allow: true})
+	}
+	count := len(blocklist.files)
+	blocklist.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	for {
+		if blocklist.changed() {
+			blocklist.Load()
+		}
+		time.Sleep(blocklistCheckInterval)
+	}
+}
+
+// changed returns true if any list has been modified since it was loaded
+func (b *Blocklist) changed() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, f := range b.files {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			if !f.modTime.IsZero() {
+				return true
+			}
+			continue
+		}
+		if !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Load reads every list, replacing the current entries
+func (b *Blocklist) Load() {
+
+	exact := make(map[string]bool)
+	suffix := make(map[string]bool)
+	allowExact := make(map[string]bool)
+	allowSuffix := make(map[string]bool)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, f := range b.files {
+		f.modTime = time.Time{}
+		f.size = 0
+		f.entries = 0
+
+		file, err := os.Open(f.path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorf("Error opening DNS list %s: %v", f.path, err)
+			}
+			continue
+		}
+		if info, err := file.Stat(); err == nil {
+			f.modTime = info.ModTime()
+			f.size = info.Size()
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			names, wildcard, exception := parseBlocklistLine(scanner.Text())
+			for _, name := range names {
+				f.entries++
+				switch {
+				case (f.allow || exception) && wildcard:
+					allowSuffix[name] = true
+				case f.allow || exception:
+					allowExact[name] = true
+				case wildcard:
+					suffix[name] = true
+				default:
+					exact[name] = true
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Errorf("Error reading DNS list %s: %v", f.path, err)
+		}
+		file.Close()
+
+		log.Infof("Loaded %d entries from DNS list %s", f.entries, f.path)
+	}
+
+	b.exact = exact
+	b.suffix = suffix
+	b.allowExact = allowExact
+	b.allowSuffix = allowSuffix
+}
+
+// hostsSelfNames are the names a hosts file gives the host itself
+var hostsSelfNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"localhost6":            true,
+	"broadcasthost":         true,
+	"local":                 true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// parseBlocklistLine returns the names in a line, whether they cover the
+// names below them, and whether they are exceptions
+func parseBlocklistLine(line string) ([]string, bool, bool) {
+
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+		return nil, false, false
+	}
+
+	// AdGuard rules
+	exception := false
+	if strings.HasPrefix(line, "@@") {
+		exception = true
+		line = line[2:]
+	}
+	if strings.HasPrefix(line, "||") {
+		line = strings.TrimPrefix(line, "||")
+		// rules with modifiers are for browsers, not DNS
+		if strings.Contains(line, "$") {
+			return nil, false, false
+		}
+		line = strings.TrimSuffix(line, "^")
+		return blockNames(normalizeBlockName(line)), true, exception
+	}
+	if exception {
+		return blockNames(normalizeBlockName(line)), false, true
+	}
+
+	// hosts file, which may have several names on a line, skipping the
+	// entries for the host itself
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		names := []string{}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "#") {
+				break
+			}
+			name := normalizeBlockName(field)
+			if name == "" || hostsSelfNames[name] {
+				continue
+			}
+			names = append(names, name)
+		}
+		return names, false, false
+	}
+
+	if strings.HasPrefix(fields[0], "*.") {
+		return blockNames(normalizeBlockName(fields[0][2:])), true, false
+	}
+
+	return blockNames(normalizeBlockName(fields[0])), false, false
+}
+
+// blockNames returns a name as a list, or nothing if it is empty
+func blockNames(name string) []string {
+	if name == "" {
+		return nil
+	}
+	return []string{name}
+}
+
+func normalizeBlockName(name string) string {
+	name = strings.ToLower(strings.Trim(name, "."))
+	if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, "/*|^") {
+		return ""
+	}
+	return name
+}
+
+// Blocked returns true if a name is on a blocklist and not on an allowlist
+func (b *Blocklist) Blocked(name string) bool {
+
+	name = strings.ToLower(strings.Trim(name, "."))
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if len(b.exact) == 0 && len(b.suffix) == 0 {
+		return false
+	}
+
+	if b.allowExact[name] || matchSuffix(b.allowSuffix, name) {
+		return false
+	}
+
+	return b.exact[name] || matchSuffix(b.suffix, name)
+}
+
+// matchSuffix returns true if name or any of its parents is in the set
+func matchSuffix(set map[string]bool, name string) bool {
+	if len(set) == 0 {
+		return false
+	}
+	for {
+		if set[name] {
+			return true
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return false
+		}
+		name = parent
+	}
+}
+
+// Status returns the lists and how many entries were loaded from each
+func (b *Blocklist) Status() []BlocklistFileStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	status := []BlocklistFileStatus{}
+	for _, f := range b.files {
+		status = append(status, BlocklistFileStatus{
+			Path:    f.path,
+			Allow:   f.allow,
+			Loaded:  f.modTime,
+			Entries: f.entries,
+		})
+	}
+	return status
+}
+
+// FilteringEnabled returns true if queries arriving at the local address
+// should be checked against the blocklists
+func FilteringEnabled(local net.Addr) bool {
+
+	host, _, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return cfg.DNSBlock
+	}
+
+	return filteringFor(host)
+}
+
+func filteringFor(address string) bool {
+	if enabled, found := global.Filtering[address]; found {
+		return enabled
+	}
+	return cfg.DNSBlock
+}
+
+// FilteringFromTags returns whether a VPN's tags turn filtering on or off
+func FilteringFromTags(tags []string) (bool, bool) {
+	for _, tag := range tags {
+		switch strings.ToLower(tag) {
+		case "dns:block":
+			return true, true
+		case "dns:noblock":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// BlockedResponse answers a blocked query according to cfg.DNSBlockMode
+func BlockedResponse(r *dns.Msg) *dns.Msg {
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	q := r.Question[0]
+	if cfg.DNSBlockMode != BlockNull {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: zoneNegative}
+	switch q.Qtype {
+	case dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+	}
+
+	return m
+}
@@ -12,6 +12,8 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nettica-com/nettica-admin/model"
@@ -19,15 +21,6 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// Global variable for status changes
-var (
-	Bounce          = false
-	FailSafe        = false
-	FailSafeActed   = false
-	FailSafeMsgSent = false
-	Count           = 0
-)
-
 var (
 	InstanceID = ""
 )
@@ -42,6 +35,7 @@ var (
 	netticaDeviceStatusAPIFmt = "%s/api/v1.0/device/%s/status"
 	netticaDeviceAPIFmt       = "%s/api/v1.0/device/%s"
 	netticaVPNUpdateAPIFmt    = "%s/api/v1.0/vpn/%s"
+	netticaDevicePushAPIFmt   = "%s/api/v1.0/device/%s/push"
 )
 
 // Client is the main client object
@@ -49,12 +43,26 @@ type Worker struct {
 	// Context is the server context
 	Context *Server `json:"context"`
 	Client  *http.Client
+
+	// pushConnected is true while the push stream is delivering updates
+	pushConnected atomic.Bool
+	// configMu serializes updates from the poll, push and background threads
+	configMu sync.Mutex
+	// bounce forces every network to be reprocessed on the next update
+	bounce atomic.Bool
+	// failsafe is this server's failover state
+	failsafe FailSafeState
+	// backoff spaces out calls to the server while it is failing
+	backoff Backoff
+	// poll records the outcome of the last poll for the status API
+	poll PollState
 }
 
 // Start the channel that iterates the nettica update function
 func (w *Worker) StartServer() {
 
 	log.Infof("StartServer Nettica Host %s", w.Context.Config.Device.Server)
+	w.backoff.Name = w.Context.Name
 	etag := ""
 	success := true
 	var err error
@@ -90,36 +98,34 @@ func (w *Worker) StartServer() {
 		} else if ip != localIP {
 			msg := fmt.Sprintf("Local IP address has changed from %s to %s.  Checking for updates...", localIP, ip)
 			NotifyInfo(msg)
-			Bounce = true
+			w.bounce.Store(true)
 			localIP = ip
 		}
 
+		// Skip this tick if the server asked us to back off
+		if wait := w.backoff.Remaining(); wait > 0 {
+			log.Debugf("Backing off %s for another %v", w.Context.Name, wait.Round(time.Second))
+			continue
+		}
+
 		etag2, err := w.GetNetticaVPN(etag)
 		if err != nil {
 			log.Errorf("Error getting nettica message: %v", err)
+			w.poll.Failure(err)
 			success = false
-			Count++
-			if Count > 3 {
-				FailSafe = true
-				log.Info("FailSafe mode enabled.")
+			if w.failsafe.Failure(err) {
+				log.Infof("FailSafe mode enabled for %s.", w.Context.Name)
 				w.Failsafe()
 			}
 		} else {
-			if !success && !Bounce {
+			if !success && !w.bounce.Load() {
 				success = true
-				Bounce = true
+				w.bounce.Store(true)
 				// NotifyInfo("Network change detected.  Checking for updates...") too mamy of these
-			} else {
-				if FailSafe {
-					if FailSafeActed {
-						NotifyInfo("FailSafe has recovered connectivity")
-					}
-				}
 			}
-			FailSafe = false
-			FailSafeActed = false
-			FailSafeMsgSent = false
-			Count = 0
+			// GetNetticaVPN has already left failsafe if it was enabled,
+			// this resets the count of failures that didn't reach it
+			w.failsafe.Success()
 
 			// If this is the first iteration, update the device info if necessary
 			if etag == "" {
@@ -143,20 +149,14 @@ func (w *Worker) StartServer() {
 			}
 
 			etag = etag2
+			w.poll.Success(etag)
 		}
 	}
 }
 
 func (w *Worker) Failsafe() error {
 
-	file, err := os.Open(w.Context.Path)
-
-	if err != nil {
-		log.Errorf("Error opening file %s %v", w.Context.Path, err)
-		return err
-	}
-	conf, err := io.ReadAll(file)
-	file.Close()
+	conf, err := ReadFileSafe(w.Context.Path, ValidJSON)
 	if err != nil {
 		log.Errorf("Error reading nettica config file: %v", err)
 		return err
@@ -395,7 +395,7 @@ func (w *Worker) CallNettica(etag *string) ([]byte, error) {
 
 	}
 
-	resp, err := w.Client.Do(req)
+	resp, err := w.send(req)
 	if err == nil {
 		body, errb := io.ReadAll(resp.Body)
 		if errb != nil {
@@ -431,6 +431,25 @@ func (w *Worker) CallNettica(etag *string) ([]byte, error) {
 
 }
 
+// send makes a request to the server unless we are backing off, and
+// records the outcome so repeated failures are spaced out
+func (w *Worker) send(req *http.Request) (*http.Response, error) {
+
+	if wait := w.backoff.Remaining(); wait > 0 {
+		return nil, fmt.Errorf("%w, next attempt in %v", errBackoff, wait.Round(time.Second))
+	}
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		w.backoff.Failure(err, 0)
+		return nil, err
+	}
+
+	w.backoff.Response(resp)
+
+	return resp, nil
+}
+
 func (w *Worker) GetNetticaDevice() (*model.Device, error) {
 
 	if !cfg.loaded {
@@ -636,7 +655,7 @@ func (w *Worker) UpdateNetticaDevice() error {
 		req.Header.Set("Accept", "application/json")
 	}
 
-	resp, err := w.Client.Do(req)
+	resp, err := w.send(req)
 	if err == nil {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -671,7 +690,15 @@ func (w *Worker) GetNetticaVPN(etag string) (string, error) {
 		}
 	}
 
+	start := time.Now()
 	body, err := w.CallNettica(&etag)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.Add("nettica_control_plane_polls_total", Labels("server", w.Context.Name, "result", result), 1)
+	metrics.Observe("nettica_control_plane_poll_duration_seconds", Labels("server", w.Context.Name), time.Since(start))
+
 	if err != nil {
 		w.Client = nil
 		if err.Error() == "Unauthorized" {
@@ -688,12 +715,14 @@ func (w *Worker) GetNetticaVPN(etag string) (string, error) {
 			log.Error(err)
 		}
 	} else {
-		if FailSafe {
-			NotifyInfo("FailSafe: connectivity restored")
-			FailSafe = false
-			FailSafeActed = false
-			FailSafeMsgSent = false
-			Count = 0
+		// Leave failsafe before applying the configuration, so the
+		// networks it changed go back to normal
+		if w.failsafe.Enabled() {
+			if w.failsafe.Success() {
+				NotifyInfo("FailSafe has recovered connectivity")
+			} else {
+				NotifyInfo("FailSafe: connectivity restored")
+			}
 		}
 		w.UpdateNetticaConfig(body, false)
 		return etag, nil
@@ -732,7 +761,7 @@ func (w *Worker) UpdateVPN(vpn *model.VPN) error {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	resp, err := w.Client.Do(req)
+	resp, err := w.send(req)
 	if err == nil {
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -744,6 +773,13 @@ func (w *Worker) UpdateVPN(vpn *model.VPN) error {
 		if resp.StatusCode != 200 {
 			log.Errorf("PATCH Error: Response %v", resp.StatusCode)
 		}
+	} else {
+		log.Errorf("ERROR: %v", err)
+	}
+
+	// The caller needs to know if the server has the change, eg. a rotated key
+	if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("update failed with status %d", resp.StatusCode)
 	}
 
 	if resp != nil {
@@ -756,14 +792,29 @@ func (w *Worker) UpdateVPN(vpn *model.VPN) error {
 	// Save the change locally
 	SaveServer(w.Context)
 
-	return nil
+	return err
 }
 
 // UpdateNetticaConfig updates the config from the server
 func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 
+	w.configMu.Lock()
+	defer w.configMu.Unlock()
+
+	// Without the key store every VPN would get a new key pair that can't
+	// be saved, so leave the running configuration alone
+	if err := KeystoreError(); err != nil {
+		log.Errorf("Not applying the configuration from %s, the key store is unreadable: %v", w.Context.Name, err)
+		return
+	}
+
+	// Take a consistent view of the failsafe state for this pass
+	failsafe := w.failsafe.Enabled()
+	failsafeMsgSent := w.failsafe.MessageSent()
+	bounce := w.bounce.Load()
+
 	defer func() {
-		Bounce = false
+		w.bounce.Store(false)
 		if r := recover(); r != nil {
 			log.Errorf("Panic in UpdateNetticaConfig: %v", r)
 			log.Errorf("Body: %s", string(body))
@@ -783,15 +834,15 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 	conf := w.Context.GetBody()
 
 	// compare the body to the current config and make no changes if they are the same
-	if bytes.Equal(conf, body) && !Bounce && !FailSafe && !isBackground {
+	if bytes.Equal(conf, body) && !bounce && !failsafe && !isBackground {
 		return
 	} else {
-		if Bounce {
+		if bounce {
 			log.Info("BOUNCE!!!")
 		}
 
-		if FailSafe {
-			log.Info("FailSafe!!!")
+		if failsafe {
+			log.Infof("FailSafe!!! (%s)", w.Context.Name)
 		}
 
 		if isBackground {
@@ -882,6 +933,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 			if !found {
 				log.Infof("Deleting net %v", oldconf.Config[i].NetName)
 				RemoveWireguard(oldconf.Config[i].NetName)
+				StopPortMapping(oldconf.Config[i].NetName)
 				os.Remove(GetDataPath() + oldconf.Config[i].NetName + ".conf")
 
 				for _, vpn := range oldconf.Config[i].VPNs {
@@ -957,8 +1009,8 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 					}
 				}
 
-				// Configure UPnP as needed
-				go ConfigureUPnP(vpn)
+				// Map the listen port on the gateway as needed
+				go ConfigurePortMapping(vpn)
 
 				// Get our local subnets
 				subnets, err := GetLocalSubnets()
@@ -982,27 +1034,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 
 				// If any of the AllowedIPs contain a local subnet, remove that entry
 				// This is to prevent routing loops and is very important
-				for k := 0; k < len(vpns); k++ {
-					allowed := vpns[k].Current.AllowedIPs
-					for l := 0; l < len(allowed); l++ {
-						inSubnet := false
-						if !strings.Contains(allowed[l], "/") {
-							continue
-						}
-						_, s, err := net.ParseCIDR(allowed[l])
-						if err != nil {
-							continue
-						}
-						for _, subnet := range subnets {
-							if subnet.Contains(s.IP) {
-								inSubnet = true
-							}
-						}
-						if inSubnet {
-							vpns[k].Current.AllowedIPs = append(allowed[:l], allowed[l+1:]...)
-						}
-					}
-				}
+				RemoveLocalAllowedIPs(vpns, subnets)
 
 				key := ""
 				// If the server has sent us a private key, and we're configured to update keys,
@@ -1045,6 +1077,19 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 					}
 				}
 
+				// Replace the key pair if it's older than the rotation policy allows
+				if w.Context.Config.Device.UpdateKeys && KeyRotationDue(vpn.Current.PublicKey, KeyRotationDays(vpn.Tags)) {
+					if rotated, ok := w.RotateKey(&vpn); ok {
+						key = rotated
+					}
+				}
+				KeyUse(vpn.Current.PublicKey, vpn.NetName)
+
+				// and the net's preshared key
+				if w.Context.Config.Device.UpdateKeys && PSKRotationDue(&vpn, vpns, KeyRotationDays(vpn.Tags)) {
+					w.RotatePSK(&vpn, vpns)
+				}
+
 				// Create a new WireGuard configuration file with the private key
 				// Create a new NetName.conf configuration file
 				text, err := DumpWireguardConfig(key, &vpn, &vpns)
@@ -1056,6 +1101,8 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 				path := GetWireguardPath()
 				name := vpn.NetName
 
+				SetKillSwitch(name, vpn.Enable && KillSwitchFromTags(vpn.Tags))
+
 				var bits []byte
 
 				file, err := os.Open(path + name + ".conf")
@@ -1072,12 +1119,12 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 				}
 
 				// FailSafe processing
-				if FailSafe {
-					log.Infof("FailSafe: %v vpn.FailSafe %v Enable %v Failover %v", FailSafe, vpn.Current.FailSafe, vpn.Enable, vpn.Failover)
+				if failsafe {
+					log.Infof("FailSafe: %v vpn.FailSafe %v Enable %v Failover %v", failsafe, vpn.Current.FailSafe, vpn.Enable, vpn.Failover)
 				}
 
 				// If we're in FailSafe, and the VPN is configured for it, and the VPN is enabled...
-				if FailSafe && vpn.Current.FailSafe && vpn.Enable {
+				if failsafe && vpn.Current.FailSafe && vpn.Enable {
 					// Check to see if the VPN is running
 					running, err := IsWireguardRunning(name)
 					if err != nil {
@@ -1088,7 +1135,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 					if running {
 
 						log.Infof("FailSafe: %s failed.  Stopping service", name)
-						if !FailSafeMsgSent {
+						if !failsafeMsgSent {
 							msg := fmt.Sprintf("FailSafe: Network %s failed. Stopping service", name)
 							NotifyInfo(msg)
 						}
@@ -1111,7 +1158,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 							log.Errorf("Error stopping wireguard: %v", err)
 						}
 
-						FailSafeActed = true
+						w.failsafe.SetActed()
 						vpn.Failover = FAILOVER
 
 						// Update the server with any luck
@@ -1122,7 +1169,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 
 						// If the VPN is not running, maybe it should be.  Start it.
 						log.Infof("FailSafe: Starting network %s", name)
-						if !FailSafeMsgSent {
+						if !failsafeMsgSent {
 							msg := fmt.Sprintf("FailSafe: Starting network %s", name)
 							NotifyInfo(msg)
 						}
@@ -1132,7 +1179,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 							log.Errorf("Error starting wireguard: %v", err)
 						}
 
-						FailSafeActed = true
+						w.failsafe.SetActed()
 
 					}
 					log.Infof(" >>>>>>>>>> Failover processing for %s <<<<<<<<<<", name)
@@ -1152,6 +1199,12 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 
 				if !force && bytes.Equal(bits, text) {
 					log.Infof("*** SKIPPING %s *** No changes!", name)
+				} else if !force && w.ApplyLive(&oldconf, &vpn, vpns, subnets, text) {
+					// Only the peers changed and they were applied to the running tunnel
+					msg := fmt.Sprintf("Network %s has been updated", name)
+					if !isBackground {
+						NotifyInfo(msg)
+					}
 				} else {
 					// reinitialize force to false for future iterations
 					force = false
@@ -1178,7 +1231,7 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 					}
 
 					if len(text) > 0 {
-						err = os.WriteFile(path+name+".conf", text, 0600)
+						err = writeFileAtomic(path+name+".conf", text, 0600)
 						if err != nil {
 							log.Errorf("Error writing file %s : %s", path+name+".conf", err)
 						}
@@ -1231,12 +1284,38 @@ func (w *Worker) UpdateNetticaConfig(body []byte, isBackground bool) {
 		}
 	}
 
-	if FailSafe {
-		FailSafeMsgSent = true
+	if failsafe {
+		w.failsafe.SetMessageSent()
 	}
 
 }
 
+// RemoveLocalAllowedIPs removes the AllowedIPs of the peers that are in
+// one of our local subnets
+func RemoveLocalAllowedIPs(vpns []model.VPN, subnets []*net.IPNet) {
+
+	for k := 0; k < len(vpns); k++ {
+		allowed := vpns[k].Current.AllowedIPs
+		kept := allowed[:0]
+		for _, a := range allowed {
+			inSubnet := false
+			if strings.Contains(a, "/") {
+				if _, s, err := net.ParseCIDR(a); err == nil {
+					for _, subnet := range subnets {
+						if subnet.Contains(s.IP) {
+							inSubnet = true
+						}
+					}
+				}
+			}
+			if !inSubnet {
+				kept = append(kept, a)
+			}
+		}
+		vpns[k].Current.AllowedIPs = kept
+	}
+}
+
 // ServiceHost containers must be hardened to prevent unauthorized access to the host
 // Check the following:
 // 1. There is only one VPN for this device
@@ -1429,6 +1508,15 @@ func (w *Worker) StartBackgroundRefreshService() {
 			w.UpdateNetticaConfig(body, true)
 		}
 
+		// Delete the rotated keys that are past their grace period, and
+		// the keys no VPN has used for a while
+		KeyCollect()
+		if cfg.KeyOrphanAge > 0 {
+			if _, err := KeyPrune(cfg.KeyOrphanAge); err != nil {
+				log.Errorf("Error pruning keys: %v", err)
+			}
+		}
+
 		// Do this startup process every hour.  Keeps UPnP ports active, handles laptop sleeps, etc.
 		time.Sleep(60 * time.Minute)
 	}
@@ -1488,34 +1576,16 @@ func DoWork() {
 			go func(s *Server) {
 
 				//log.Infof("Server: %v", s)
-				var curTs int64
 
 				w := Worker{Context: s}
 				s.Worker = &w
 
 				go w.StartServer()
 				go w.StartBackgroundRefreshService()
+				go w.StartPushService()
 				go DoServiceWork(s)
 
-				curTs = calculateCurrentTimestamp()
-
-				t := time.Unix(curTs, 0)
-				log.Debugf("current timestamp = %v (%s)", curTs, t.UTC())
-
-				for !s.Shutdown {
-					time.Sleep(1000 * time.Millisecond)
-					ts := time.Now()
-
-					if ts.Unix() >= curTs {
-
-						w.Context.Running <- true
-
-						curTs = calculateCurrentTimestamp()
-						curTs += w.Context.Config.Device.CheckInterval
-					}
-				}
-
-				w.Context.Running <- false
+				w.Poll()
 
 			}(s)
 		}
@@ -3,7 +3,9 @@ package main
 import (
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // var device model.Device = model.Device{}
@@ -22,6 +24,40 @@ var cfg struct {
 	DeviceID   string
 	ApiKey     string
 	UpdateKeys bool
+	Push       bool
+
+	FailSafeThreshold  int
+	WireguardBackend   string
+	BackoffBase        time.Duration
+	BackoffMax         time.Duration
+	MetricsAddress     string
+	AllowedOrigins     []string
+	Socket             string
+	SocketGroup        string
+	SocketAdminGroup   string
+	DNSCacheSize       int
+	DNSBootstrap       string
+	DNSStrategy        string
+	DNSTransferAllow   []string
+	DNSBlock           bool
+	DNSBlockMode       string
+	DNSBlocklists      []string
+	DNSAllowlists      []string
+	DNSForwardFile     string
+	DNSLogSize         int
+	DNSLogFile         string
+	DNSLogMaxSize      int64
+	DNSRequireDNSSEC   bool
+	MDNSInterfaces     []string
+	KillSwitchAllow    []string
+	KeystoreProvider   string
+	KeystoreCredential string
+	KeystoreKeyring    string
+	KeyRotationDays    int
+	KeyGracePeriod     time.Duration
+	KeyOrphanAge       time.Duration
+	PortMapper         string
+	PortMapGateway     string
 }
 
 func loadConfig() error {
@@ -39,6 +75,11 @@ func loadConfig() error {
 		cfg.debug = false
 		cfg.quiet = false
 		cfg.UpdateKeys = true
+		cfg.Push = true
+		cfg.FailSafeThreshold = 3
+		cfg.BackoffBase = 5 * time.Second
+		cfg.BackoffMax = 5 * time.Minute
+		cfg.DNSCacheSize = 4096
 
 		// load defaults from environment
 		cfg.Server = os.Getenv("NETTICA_SERVER")
@@ -67,10 +108,185 @@ func loadConfig() error {
 			cfg.UpdateKeys = false
 		}
 
+		if strings.ToLower(os.Getenv("NETTICA_PUSH")) == "false" {
+			cfg.Push = false
+		}
+
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_FAILSAFE_THRESHOLD")); err == nil && value > 0 {
+			cfg.FailSafeThreshold = value
+		}
+
+		// control plane retry delays, in seconds
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_BACKOFF_BASE")); err == nil && value > 0 {
+			cfg.BackoffBase = time.Duration(value) * time.Second
+		}
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_BACKOFF_MAX")); err == nil && value > 0 {
+			cfg.BackoffMax = time.Duration(value) * time.Second
+		}
+		if cfg.BackoffMax < cfg.BackoffBase {
+			cfg.BackoffMax = cfg.BackoffBase
+		}
+
+		// maximum number of cached DNS responses, 0 disables the cache
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_DNS_CACHE_SIZE")); err == nil && value >= 0 {
+			cfg.DNSCacheSize = value
+		}
+
+		// number of recent queries kept for /dns/log, 0 disables the log
+		cfg.DNSLogSize = 1000
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_DNS_LOG_SIZE")); err == nil && value >= 0 {
+			cfg.DNSLogSize = value
+		}
+
+		// optionally append every query to a JSON lines file, rotated at
+		// NETTICA_DNS_LOG_MAX_SIZE bytes (10MB by default)
+		cfg.DNSLogFile = os.Getenv("NETTICA_DNS_LOG_FILE")
+		cfg.DNSLogMaxSize = 10 * 1024 * 1024
+		if value, err := strconv.ParseInt(os.Getenv("NETTICA_DNS_LOG_MAX_SIZE"), 10, 64); err == nil && value >= 0 {
+			cfg.DNSLogMaxSize = value
+		}
+
+		// plain resolver used to look up DNS over TLS and HTTPS servers.
+		// The system resolver by default, so the names we look up aren't
+		// sent to a third party, see upstream.go.
+		cfg.DNSBootstrap = os.Getenv("NETTICA_DNS_BOOTSTRAP")
+		if _, _, err := net.SplitHostPort(cfg.DNSBootstrap); err != nil && cfg.DNSBootstrap != "" {
+			cfg.DNSBootstrap = net.JoinHostPort(cfg.DNSBootstrap, "53")
+		}
+
+		// sequential (default) or parallel, can be overridden per network
+		// with a dns:parallel or dns:sequential tag
+		cfg.DNSStrategy = StrategySequential
+		if strings.ToLower(os.Getenv("NETTICA_DNS_STRATEGY")) == StrategyParallel {
+			cfg.DNSStrategy = StrategyParallel
+		}
+
+		// addresses or CIDRs allowed to AXFR the mesh zones, none by default
+		for _, allowed := range strings.Split(os.Getenv("NETTICA_DNS_AXFR_ALLOW"), ",") {
+			if allowed = strings.TrimSpace(allowed); allowed != "" {
+				cfg.DNSTransferAllow = append(cfg.DNSTransferAllow, allowed)
+			}
+		}
+
+		// blocklists and allowlists, hosts or AdGuard format, reloaded when they change
+		cfg.DNSBlocklists = splitList(os.Getenv("NETTICA_DNS_BLOCKLISTS"))
+		if len(cfg.DNSBlocklists) == 0 {
+			cfg.DNSBlocklists = []string{GetDataPath() + "blocklist.txt"}
+		}
+		cfg.DNSAllowlists = splitList(os.Getenv("NETTICA_DNS_ALLOWLISTS"))
+		if len(cfg.DNSAllowlists) == 0 {
+			cfg.DNSAllowlists = []string{GetDataPath() + "allowlist.txt"}
+		}
+
+		// local conditional forwarding rules, eg. corp.example.com 10.0.0.53
+		cfg.DNSForwardFile = os.Getenv("NETTICA_DNS_FORWARD_FILE")
+		if cfg.DNSForwardFile == "" {
+			cfg.DNSForwardFile = GetDataPath() + "forward.conf"
+		}
+
+		// only accept answers from public resolvers that validated them
+		cfg.DNSRequireDNSSEC, _ = strconv.ParseBool(os.Getenv("NETTICA_DNS_REQUIRE_DNSSEC"))
+
+		// interfaces the mDNS bridge listens on, the default multicast
+		// interface if not set
+		cfg.MDNSInterfaces = splitList(os.Getenv("NETTICA_MDNS_INTERFACES"))
+
+		// filter every network, otherwise only those with a dns:block tag
+		cfg.DNSBlock, _ = strconv.ParseBool(os.Getenv("NETTICA_DNS_BLOCK"))
+
+		// nxdomain (default) or null to answer 0.0.0.0 and ::
+		cfg.DNSBlockMode = BlockNXDomain
+		if strings.ToLower(os.Getenv("NETTICA_DNS_BLOCK_MODE")) == BlockNull {
+			cfg.DNSBlockMode = BlockNull
+		}
+
+		// destinations the kill switch allows outside the tunnel, the
+		// local networks by default
+		cfg.KillSwitchAllow = splitList(os.Getenv("NETTICA_KILLSWITCH_ALLOW"))
+		if len(cfg.KillSwitchAllow) == 0 {
+			cfg.KillSwitchAllow = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "224.0.0.0/4", "255.255.255.255/32",
+				"fe80::/10", "fc00::/7", "ff00::/8"}
+		}
+
+		// where the key that encrypts keys.keys comes from: auto (default),
+		// systemd-creds, keyring, passphrase or none
+		cfg.KeystoreProvider = strings.ToLower(os.Getenv("NETTICA_KEYSTORE"))
+		if cfg.KeystoreProvider == "" {
+			cfg.KeystoreProvider = "auto"
+		}
+		cfg.KeystoreCredential = os.Getenv("NETTICA_KEYSTORE_CREDENTIAL")
+		if cfg.KeystoreCredential == "" {
+			cfg.KeystoreCredential = "nettica-keystore"
+		}
+		cfg.KeystoreKeyring = os.Getenv("NETTICA_KEYSTORE_KEYRING")
+		if cfg.KeystoreKeyring == "" {
+			cfg.KeystoreKeyring = "nettica:keystore"
+		}
+
+		// replace each VPN's key pair after this many days, 0 (default)
+		// never.  A keyrotate:<days> tag overrides it for one VPN.
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_KEY_ROTATION_DAYS")); err == nil && value >= 0 {
+			cfg.KeyRotationDays = value
+		}
+
+		// how long a replaced private key is kept, in days
+		cfg.KeyGracePeriod = 7 * 24 * time.Hour
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_KEY_GRACE_DAYS")); err == nil && value >= 0 {
+			cfg.KeyGracePeriod = time.Duration(value) * 24 * time.Hour
+		}
+
+		// delete keys no VPN has used for this many days, 0 never
+		cfg.KeyOrphanAge = 30 * 24 * time.Hour
+		if value, err := strconv.Atoi(os.Getenv("NETTICA_KEY_ORPHAN_DAYS")); err == nil && value >= 0 {
+			cfg.KeyOrphanAge = time.Duration(value) * 24 * time.Hour
+		}
+
+		// how a VPN's port is mapped on the gateway: auto (default), pcp,
+		// natpmp or upnp
+		cfg.PortMapper = strings.ToLower(os.Getenv("NETTICA_PORTMAP"))
+		if cfg.PortMapper == "" {
+			cfg.PortMapper = "auto"
+		}
+
+		// the PCP and NAT-PMP server as address[:port], the default
+		// gateway if not set
+		cfg.PortMapGateway = os.Getenv("NETTICA_PORTMAP_GATEWAY")
+
+		// serve /metrics on a separate address, eg. 0.0.0.0:9586
+		cfg.MetricsAddress = os.Getenv("NETTICA_METRICS_ADDRESS")
+
+		// native (default) or wg-quick, only used on Linux
+		cfg.WireguardBackend = strings.ToLower(os.Getenv("NETTICA_WG_BACKEND"))
+
 		if cfg.Server == "" {
 			cfg.Server = "https://my.nettica.com"
 		}
 
+		// optionally serve the local API on a unix socket, eg. /run/nettica/nettica.sock
+		cfg.Socket = os.Getenv("NETTICA_SOCKET")
+		cfg.SocketGroup = os.Getenv("NETTICA_SOCKET_GROUP")
+		if cfg.SocketGroup == "" {
+			cfg.SocketGroup = "nettica"
+		}
+		// optionally let members of this group read and change keys and
+		// configuration through the socket, which is otherwise root only
+		cfg.SocketAdminGroup = os.Getenv("NETTICA_SOCKET_ADMIN_GROUP")
+
+		// origins allowed to call the local API from a browser
+		cfg.AllowedOrigins = []string{"https://my.nettica.com"}
+		if !strings.EqualFold(strings.TrimSuffix(cfg.Server, "/"), "https://my.nettica.com") {
+			cfg.AllowedOrigins = append(cfg.AllowedOrigins, strings.ToLower(strings.TrimSuffix(cfg.Server, "/")))
+		}
+		if value := os.Getenv("NETTICA_ALLOWED_ORIGINS"); value != "" {
+			cfg.AllowedOrigins = []string{}
+			for _, origin := range strings.Split(value, ",") {
+				origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+				if origin != "" {
+					cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
+				}
+			}
+		}
+
 		var err error
 		cfg.sourceAddr, err = net.ResolveTCPAddr("tcp", "0.0.0.0:0")
 		if err != nil {
@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -22,10 +23,14 @@ type DNS_SERVER struct {
 }
 
 type DNS struct {
-	DnsTable      map[string][]string    // List of DNS entries.  key is the name of the entry.  value is the address or host name for PTR records
-	Resolvers     []string               // List of external DNS resolvers
+	Zone          *Zone                  // Records for the names in the mesh, including PTR records
+	Resolvers     []*Upstream            // List of external DNS resolvers
 	DnsServers    map[string]*DNS_SERVER // List of Nettica DNS servers.  key is the address of the server
 	SearchDomains []string               // List of search domains for lookups and to backhole queries to external resolvers
+	Strategies    map[string]string      // How each Nettica DNS server queries the resolvers.  key is the address of the server
+	Filtering     map[string]bool        // Whether each Nettica DNS server checks the blocklists.  key is the address of the server
+	Forwarders    map[string][]*Upstream // Resolvers for queries in specific domains.  key is the domain
+	Bridges       map[string]string      // Our name in each network bridged to mDNS.  key is the network name
 }
 
 var (
@@ -73,6 +78,8 @@ func StartDNS() error {
 
 	InitializeDNS()
 
+	blocklistOnce.Do(func() { go StartBlocklists() })
+
 	for exists := false; !exists; {
 
 		if len(Servers) == 0 {
@@ -83,10 +90,14 @@ func StartDNS() error {
 	}
 
 	var aggregate DNS
-	aggregate.DnsTable = make(map[string][]string)
+	aggregate.Zone = NewZone()
 	aggregate.DnsServers = make(map[string]*DNS_SERVER)
-	aggregate.Resolvers = make([]string, 0)
+	aggregate.Resolvers = make([]*Upstream, 0)
 	aggregate.SearchDomains = make([]string, 0)
+	aggregate.Strategies = make(map[string]string)
+	aggregate.Filtering = make(map[string]bool)
+	aggregate.Forwarders = make(map[string][]*Upstream)
+	aggregate.Bridges = make(map[string]string)
 
 	for _, s := range Servers {
 
@@ -108,11 +119,30 @@ func StartDNS() error {
 		for address, server := range d.DnsServers {
 			aggregate.DnsServers[address] = server
 		}
-		for label, name := range d.DnsTable {
-			aggregate.DnsTable[label] = name
+		aggregate.Zone.Merge(d.Zone)
+		for address, strategy := range d.Strategies {
+			aggregate.Strategies[address] = strategy
+		}
+		for address, enabled := range d.Filtering {
+			aggregate.Filtering[address] = enabled
+		}
+		for domain, resolvers := range d.Forwarders {
+			aggregate.Forwarders[domain] = removeDuplicateUpstreams(append(aggregate.Forwarders[domain], resolvers...))
+		}
+		for netName, site := range d.Bridges {
+			aggregate.Bridges[netName] = site
 		}
 	}
 
+	// Local forwarding rules replace the ones from the networks
+	forwarders, err := LoadForwardFile(cfg.DNSForwardFile)
+	if err != nil {
+		log.Errorf("Error reading DNS forwarding rules from %s: %v", cfg.DNSForwardFile, err)
+	}
+	for domain, resolvers := range forwarders {
+		aggregate.Forwarders[domain] = resolvers
+	}
+
 	// loop through the dns server and stop them if they are not in the new list
 	for address, server := range global.DnsServers {
 		found := false
@@ -138,8 +168,21 @@ func StartDNS() error {
 	globalLock.Lock()
 	defer globalLock.Unlock()
 
+	aggregate.Resolvers = removeDuplicateUpstreams(aggregate.Resolvers)
+
+	// Cached answers may have come from resolvers that are no longer in
+	// use, or be for names the zone now answers
+	flush := !slices.Equal(UpstreamNames(global.Resolvers), UpstreamNames(aggregate.Resolvers)) ||
+		!reflect.DeepEqual(ForwarderNames(global.Forwarders), ForwarderNames(aggregate.Forwarders)) ||
+		!aggregate.Zone.Equal(global.Zone)
+
+	aggregate.Zone.UpdateSerials(global.Zone)
 	global = aggregate
 
+	if flush {
+		dnsCache.Flush()
+	}
+
 	// loop through the dns servers and start them
 	for address, s := range global.DnsServers {
 		if s == nil {
@@ -150,9 +193,12 @@ func StartDNS() error {
 		}
 	}
 
-	global.Resolvers = removeDuplicates(global.Resolvers)
+	mdnsBridge.Configure(global.Bridges)
 
-	log.Infof("DNS Resolvers: %v", global.Resolvers)
+	log.Infof("DNS Resolvers: %v", UpstreamNames(global.Resolvers))
+	if len(global.Forwarders) > 0 {
+		log.Infof("DNS Forwarders: %v", ForwarderNames(global.Forwarders))
+	}
 
 	return nil
 }
@@ -162,9 +208,13 @@ func ParseMessage(msg model.Message) (*DNS, error) {
 	var d DNS
 	var host model.VPN
 
-	d.DnsTable = make(map[string][]string)
+	d.Zone = NewZone()
 	d.DnsServers = make(map[string]*DNS_SERVER)
 	d.SearchDomains = make([]string, 0)
+	d.Strategies = make(map[string]string)
+	d.Filtering = make(map[string]bool)
+	d.Forwarders = make(map[string][]*Upstream)
+	d.Bridges = make(map[string]string)
 
 	for i := 0; i < len(msg.Config); i++ {
 		index := -1
@@ -191,16 +241,29 @@ func ParseMessage(msg model.Message) (*DNS, error) {
 						if err != nil {
 							log.Errorf("can't generate reverse DNS label for %s", address)
 						} else {
-							d.DnsTable[label] = []string{name}
+							d.Zone.AddPTR(label, name)
 						}
 					} else {
 						// ipv4
 						digits := strings.Split(address, ".")
 						label := fmt.Sprintf("%s.%s.%s.%s.in-addr.arpa", digits[3], digits[2], digits[1], digits[0])
-						d.DnsTable[label] = []string{name}
+						d.Zone.AddPTR(label, name)
+					}
+					for _, address := range msg.Config[i].VPNs[j].Current.Address {
+						d.Zone.AddAddress(name, address)
+					}
+					d.Zone.AddTags(name, host.NetName, msg.Config[i].VPNs[j].Tags)
+				}
+
+				// We are authoritative for the network, along with the
+				// other Nettica DNS servers in it
+				servers := []string{}
+				for j := 0; j < len(msg.Config[i].VPNs); j++ {
+					if msg.Config[i].VPNs[j].Enable && msg.Config[i].VPNs[j].Current.EnableDns {
+						servers = append(servers, msg.Config[i].VPNs[j].Name)
 					}
-					d.DnsTable[name] = append(d.DnsTable[name], msg.Config[i].VPNs[j].Current.Address...)
 				}
+				d.Zone.AddOrigin(host.NetName, servers)
 
 				// remove the host address from the list of resolvers
 				resolver := host.Current.Dns
@@ -212,8 +275,22 @@ func ParseMessage(msg model.Message) (*DNS, error) {
 					}
 				}
 
-				d.Resolvers = append(d.Resolvers, resolver...)
-				d.Resolvers = removeDuplicates(d.Resolvers)
+				for j := 0; j < len(resolver); j++ {
+					if IsForwardRule(resolver[j]) {
+						d.AddForwardRule(resolver[j])
+						continue
+					}
+					if !IsUpstream(resolver[j]) {
+						continue
+					}
+					upstream, err := GetUpstream(resolver[j])
+					if err != nil {
+						log.Errorf("Invalid resolver %s: %v", resolver[j], err)
+						continue
+					}
+					d.Resolvers = append(d.Resolvers, upstream)
+				}
+				d.Resolvers = removeDuplicateUpstreams(d.Resolvers)
 
 				// Use the first address for the DNS server
 				address := host.Current.Address[0]
@@ -224,6 +301,29 @@ func ParseMessage(msg model.Message) (*DNS, error) {
 				// Add the server to the list of servers, but don't start it yet
 				d.DnsServers[address] = nil
 
+				if strategy := StrategyFromTags(host.Tags); strategy != "" {
+					d.Strategies[address] = strategy
+				}
+				if enabled, found := FilteringFromTags(host.Tags); found {
+					d.Filtering[address] = enabled
+				}
+
+				// Names below a VPN that bridges mDNS are answered by its
+				// DNS server
+				if BridgeFromTags(host.Tags) {
+					d.Bridges[strings.ToLower(host.NetName)] = strings.ToLower(host.Name)
+				}
+				for j := 0; j < len(msg.Config[i].VPNs); j++ {
+					vpn := msg.Config[i].VPNs[j]
+					if j == index || !vpn.Enable || !vpn.Current.EnableDns || !BridgeFromTags(vpn.Tags) || len(vpn.Current.Address) == 0 {
+						continue
+					}
+					bridge := strings.Split(vpn.Current.Address[0], "/")[0]
+					if err := d.AddForwarder(strings.ToLower(vpn.Name), bridge); err != nil {
+						log.Errorf("Invalid mDNS bridge address for %s: %v", vpn.Name, err)
+					}
+				}
+
 			}
 
 			// add the search domains.  the network name is a search domain
@@ -231,22 +331,12 @@ func ParseMessage(msg model.Message) (*DNS, error) {
 
 			search := host.Current.Dns
 			for j := 0; j < len(search); j++ {
-				ip := net.ParseIP(search[j])
-				// if it's not an ip address then it's a search domain
-				if ip == nil {
+				// if it's not a resolver then it's a search domain
+				if !IsUpstream(search[j]) && !IsForwardRule(search[j]) {
 					d.SearchDomains = append(d.SearchDomains, search[j])
 				}
 			}
 			d.SearchDomains = removeDuplicates(d.SearchDomains)
-
-			// remove any non-ip address from the resolvers
-			for j := 0; j < len(d.Resolvers); j++ {
-				ip := net.ParseIP(d.Resolvers[j])
-				if ip == nil {
-					d.Resolvers = append(d.Resolvers[:j], d.Resolvers[j+1:]...)
-					j--
-				}
-			}
 		}
 	}
 
@@ -265,6 +355,41 @@ func removeDuplicates(list []string) []string {
 	return list
 }
 
+func removeDuplicateUpstreams(list []*Upstream) []*Upstream {
+	for i := 0; i < len(list); i++ {
+		for j := i + 1; j < len(list); j++ {
+			if list[i].String() == list[j].String() {
+				list = append(list[:j], list[j+1:]...)
+				j--
+			}
+		}
+	}
+	return list
+}
+
+// ResolverStrategy returns how to query the resolvers for a query that
+// arrived at the given local address
+func ResolverStrategy(local net.Addr) string {
+
+	host, _, err := net.SplitHostPort(local.String())
+	if err == nil {
+		if strategy, found := global.Strategies[host]; found {
+			return strategy
+		}
+	}
+
+	return cfg.DNSStrategy
+}
+
+// UpstreamNames returns the resolvers as they appear in the configuration
+func UpstreamNames(list []*Upstream) []string {
+	names := make([]string, 0, len(list))
+	for _, u := range list {
+		names = append(names, u.String())
+	}
+	return names
+}
+
 func formatIPv6PTR(address string) (string, error) {
 
 	parts := strings.Split(address, ":")
@@ -322,7 +447,8 @@ func DropCache() error {
 	globalLock.Lock()
 	defer globalLock.Unlock()
 
-	global.DnsTable = make(map[string][]string)
+	global.Zone = NewZone()
+	dnsCache.Flush()
 
 	return nil
 }
@@ -334,104 +460,148 @@ func UpdateDNS() error {
 }
 
 func handleQueries(w dns.ResponseWriter, r *dns.Msg) {
-	var rr dns.RR
 
 	start := time.Now()
 
+	w = &ednsWriter{ResponseWriter: w, query: r}
+	rec := &dnsRecorder{ResponseWriter: w, rcode: -1, source: "upstream"}
+	w = rec
+	defer CountQuery(rec, r.Question[0].Qtype)
+	defer LogQuery(rec, r.Question[0], start)
+
 	q := strings.ToLower(r.Question[0].Name)
 	q = strings.Trim(q, ".")
 
-	//	if !device.Quiet {
-	log.Errorf("DNS Query: %s %s %s", w.RemoteAddr(), q, dns.TypeToString[r.Question[0].Qtype])
-	//	}
+	zone := global.Zone
+	if zone != nil {
+		origin := zone.Origin(q)
 
-	switch r.Question[0].Qtype {
-
-	case dns.TypeA, dns.TypeAAAA, dns.TypePTR:
+		if r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR {
+			SetQuerySource(w, "local")
+			TransferZone(w, r, zone, origin)
+			return
+		}
 
-		addrs := global.DnsTable[q]
-		if addrs != nil {
-			log.Debugf("--- Query from DnsTable: %s", q)
+		answer, extra, found := zone.Answer(r.Question[0])
+		if !found {
+			answer, extra, found = mdnsBridge.Answer(r.Question[0])
+		}
+		// Names below a VPN that bridges mDNS are answered by its server
+		if !found && origin != "" {
+			if _, forwarders := Forwarder(q); forwarders != nil {
+				origin = ""
+			}
+		}
+		if found || origin != "" {
+			log.Debugf("--- Query from Zone: %s", q)
+			SetQuerySource(w, "local")
 			m := new(dns.Msg)
 			m.SetReply(r)
 			m.Compress = true
 			m.RecursionAvailable = true
-
-			if r.Question[0].Qtype == dns.TypePTR {
-				rr = &dns.PTR{Hdr: dns.RR_Header{Name: r.Question[0].Name,
-					Rrtype: dns.TypePTR,
-					Class:  dns.ClassINET,
-					Ttl:    300},
-					Ptr: addrs[0] + ".",
+			m.Authoritative = origin != ""
+			m.Answer = answer
+			m.Extra = extra
+			m.Rcode = dns.RcodeSuccess
+			if origin != "" && len(answer) == 0 {
+				// NXDOMAIN if the name doesn't exist, otherwise NODATA
+				if !zone.Exists(q) {
+					m.Rcode = dns.RcodeNameError
 				}
-				m.Answer = append(m.Answer, rr)
-				//m.Authoritative = true
-				m.Rcode = dns.RcodeSuccess
-			}
-
-			if r.Question[0].Qtype == dns.TypeA {
-				offset := rand.Intn(len(addrs))
-				for i := 0; i < len(addrs); i++ {
-					x := (offset + i) % len(addrs)
-					var ip net.IP
-					if !strings.Contains(addrs[x], ":") {
-						if !strings.Contains(addrs[x], "/") {
-							ip = net.ParseIP(addrs[x])
-						} else {
-							ip, _, _ = net.ParseCIDR(addrs[x])
-						}
-						rr = &dns.A{Hdr: dns.RR_Header{Name: r.Question[0].Name,
-							Rrtype: dns.TypeA,
-							Class:  dns.ClassINET,
-							Ttl:    300},
-							A: ip.To4(),
-						}
-						m.Answer = append(m.Answer, rr)
-						//m.Authoritative = true
-						m.Rcode = dns.RcodeSuccess
-					}
-				}
-			}
-			if r.Question[0].Qtype == dns.TypeAAAA {
-				offset := rand.Intn(len(addrs))
-				for i := 0; i < len(addrs); i++ {
-					x := (offset + i) % len(addrs)
-					var ip net.IP
-					if strings.Contains(addrs[x], ":") {
-						if strings.Contains(addrs[x], "/") {
-							ip, _, _ = net.ParseCIDR(addrs[x])
-						} else {
-							ip = net.ParseIP(addrs[x])
-						}
-						rr = &dns.AAAA{Hdr: dns.RR_Header{Name: r.Question[0].Name,
-							Rrtype: dns.TypeAAAA,
-							Class:  dns.ClassINET,
-							Ttl:    300},
-							AAAA: ip.To16(),
-						}
-						m.Answer = append(m.Answer, rr)
-						//m.Authoritative = true
-						m.Rcode = dns.RcodeSuccess
-					}
+				if soa := zone.NegativeSOA(origin); soa != nil {
+					m.Ns = []dns.RR{soa}
 				}
 			}
 			w.WriteMsg(m)
 			go LogMessage(q)
-			end := time.Now()
-			log.Errorf("DNS Query: %s %s %s %v ms", w.RemoteAddr(), q, dns.TypeToString[r.Question[0].Qtype], end.Sub(start))
-			return
-		} else {
-
-			QueryDNS(w, r)
-			end := time.Now()
-			log.Errorf("DNS Query: %s %s %s %v ms", w.RemoteAddr(), q, dns.TypeToString[r.Question[0].Qtype], end.Sub(start))
 			return
 		}
 	}
 
+	if FilteringEnabled(w.LocalAddr()) && blocklist.Blocked(q) {
+		log.Debugf("--- Query to blocklist blocked: %s", q)
+		SetQuerySource(w, "filtered")
+		w.WriteMsg(BlockedResponse(r))
+		go NotifyDNS(q + " (blocked)")
+		return
+	}
+
 	QueryDNS(w, r)
-	end := time.Now()
-	log.Errorf("DNS Query: %s %s %s %v ms", w.RemoteAddr(), q, dns.TypeToString[r.Question[0].Qtype], end.Sub(start))
+}
+
+// TransferZone answers an AXFR for a network.  Transfers are only allowed
+// over TCP from the addresses in cfg.DNSTransferAllow.  IXFR is answered
+// with a full transfer.
+func TransferZone(w dns.ResponseWriter, r *dns.Msg, zone *Zone, origin string) {
+
+	refuse := func(reason string) {
+		log.Infof("--- Zone transfer of %s refused for %s: %s", r.Question[0].Name, w.RemoteAddr(), reason)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+	}
+
+	if origin == "" || origin != zoneKey(r.Question[0].Name) {
+		refuse("not authoritative")
+		return
+	}
+	if w.RemoteAddr().Network() != "tcp" {
+		refuse("not tcp")
+		return
+	}
+	if !TransferAllowed(w.RemoteAddr()) {
+		refuse("not allowed")
+		return
+	}
+
+	records := zone.Transfer(origin)
+	log.Infof("--- Zone transfer of %s to %s, %d records", origin, w.RemoteAddr(), len(records))
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tr.Out(w, r, ch)
+	}()
+
+	// Send the records in batches to stay under the message size limit
+	for len(records) > 0 {
+		n := min(len(records), 100)
+		ch <- &dns.Envelope{RR: records[:n]}
+		records = records[n:]
+	}
+	close(ch)
+
+	if err := <-errc; err != nil {
+		log.Errorf("Error transferring zone %s: %v", origin, err)
+	}
+	w.Close()
+}
+
+// TransferAllowed returns true if an address may transfer our zones
+func TransferAllowed(addr net.Addr) bool {
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range cfg.DNSTransferAllow {
+		if strings.Contains(allowed, "/") {
+			_, network, err := net.ParseCIDR(allowed)
+			if err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Make a recursive query
@@ -442,6 +612,40 @@ func QueryDNS(w dns.ResponseWriter, query *dns.Msg) {
 	q := strings.ToLower(query.Question[0].Name)
 	q = strings.Trim(q, ".")
 
+	if cached := dnsCache.Get(query); cached != nil {
+		log.Debugf("--- Query from cache: %s", q)
+		SetQuerySource(w, "cache")
+		w.WriteMsg(cached)
+		return
+	}
+
+	// The last NXDOMAIN from an upstream resolver is returned if none of
+	// them have an answer
+	var negative *dns.Msg
+
+	strategy := ResolverStrategy(w.LocalAddr())
+	upstream := UpstreamQuery(query)
+
+	// Domains with forwarding rules only go to their own resolvers
+	if domain, forwarders := Forwarder(q); forwarders != nil {
+		log.Debugf("--- Query forwarded for %s: %s", domain, q)
+		SetQuerySource(w, "forwarded")
+		response, nxdomain := QueryUpstreams(forwarders, upstream, w.RemoteAddr().Network(), strategy)
+		if response == nil {
+			response = nxdomain
+		}
+		if response != nil {
+			response.RecursionAvailable = true
+			dnsCache.Put(query, response)
+			w.WriteMsg(response)
+			return
+		}
+		query.RecursionAvailable = true
+		query.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(query)
+		return
+	}
+
 	fBLockSearch := false
 	// Check for a search domain
 	for i := 0; i < len(global.SearchDomains); i++ {
@@ -468,51 +672,55 @@ func QueryDNS(w dns.ResponseWriter, query *dns.Msg) {
 
 	for x := 0; x < 2; x++ {
 
+		tier := []*Upstream{}
 		for i := 0; i < len(global.Resolvers); i++ {
 
-			ip := net.ParseIP(global.Resolvers[i])
-			if ip == nil {
-				log.Errorf("Invalid IP address: %s", global.Resolvers[i])
-				continue
-			}
+			resolver := global.Resolvers[i]
 
-			if !ip.IsPrivate() && !ip.IsLoopback() && (fBlackhole || fBLockSearch) {
+			if !resolver.Internal() && (fBlackhole || fBLockSearch) {
 
-				log.Infof("Skipping %s", global.Resolvers[i])
+				log.Debugf("Skipping %s", resolver)
 				continue
 			}
 
 			// Manage when to call internal and external resolvers
-			if x == 0 && !ip.IsPrivate() && !ip.IsLoopback() {
+			if x == 0 && !resolver.Internal() {
 				continue
 			}
 
-			if x == 1 && (ip.IsPrivate() || ip.IsLoopback()) {
+			if x == 1 && resolver.Internal() {
 				continue
 			}
 
-			// Now make the query
-			// TODO: Handle large tcp zone transfers
-			var err error
-			response, err := MakeQuery(global.Resolvers[i]+":53", w.RemoteAddr().Network(), query)
-			if err == nil {
+			tier = append(tier, resolver)
+		}
 
-				if response.Rcode == dns.RcodeSuccess {
-					response.RecursionAvailable = true
-					w.WriteMsg(response)
-					return
-				}
+		// Now make the query
+		response, nxdomain := QueryUpstreams(tier, upstream, w.RemoteAddr().Network(), strategy)
 
-				log.Infof("--- Query to %s failed: %s %s", global.Resolvers[i], q, dns.RcodeToString[response.Rcode])
+		// Public resolvers must have validated the answer if required
+		if x == 1 && response != nil && !Validated(response) {
+			log.Debugf("--- Unvalidated answer discarded: %s", q)
+			response = nil
+		}
+		if x == 1 && nxdomain != nil && !Validated(nxdomain) {
+			nxdomain = nil
+		}
 
-			} else {
-				log.Errorf("*** Error: %s %v", q, err)
-			}
+		if response != nil {
+			response.RecursionAvailable = true
+			dnsCache.Put(query, response)
+			w.WriteMsg(response)
+			return
+		}
+		if nxdomain != nil {
+			negative = nxdomain
 		}
 	}
 
 	if fBLockSearch {
-		log.Infof("--- Query to SearchDomains blocked: %s", q)
+		log.Debugf("--- Query to SearchDomains blocked: %s", q)
+		SetQuerySource(w, "blocked")
 		// query.Authoritative = true
 		query.RecursionAvailable = true
 		query.Rcode = dns.RcodeNameError
@@ -520,7 +728,8 @@ func QueryDNS(w dns.ResponseWriter, query *dns.Msg) {
 		return
 	}
 	if fBlackhole {
-		log.Infof("--- Query to Blackhole blocked: %s", q)
+		log.Debugf("--- Query to Blackhole blocked: %s", q)
+		SetQuerySource(w, "blocked")
 		// query.Authoritative = true
 		query.RecursionAvailable = true
 		query.Rcode = dns.RcodeNameError
@@ -528,7 +737,15 @@ func QueryDNS(w dns.ResponseWriter, query *dns.Msg) {
 		return
 	}
 
+	if negative != nil {
+		negative.RecursionAvailable = true
+		dnsCache.Put(query, negative)
+		w.WriteMsg(negative)
+		return
+	}
+
 	// query.Authoritative = true
+	SetQuerySource(w, "failed")
 	query.RecursionAvailable = true
 	query.Rcode = dns.RcodeServerFailure
 	w.WriteMsg(query)
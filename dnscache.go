@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cache of answers from upstream resolvers.
+//
+// Entries are keyed by (name, type, class, DO, CD, client subnet) and expire with the smallest
+// TTL in the answer.  NXDOMAIN and NODATA responses are cached using the
+// SOA in the authority section as described in RFC 2308.  When the cache
+// is full the least recently used entry is evicted.
+
+const (
+	dnsCacheMaxTTL      = 24 * time.Hour
+	dnsCacheMaxNegative = 3 * time.Hour
+)
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+	class uint16
+	do    bool
+	cd    bool
+	ecs   string // the client subnet option's source prefix
+}
+
+type dnsCacheEntry struct {
+	key      dnsCacheKey
+	msg      *dns.Msg
+	stored   time.Time
+	expires  time.Time
+	negative bool
+	hits     int
+}
+
+// DNSCacheEntry is the read-only view of a cache entry for the local API
+type DNSCacheEntry struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Class    string    `json:"class"`
+	Rcode    string    `json:"rcode"`
+	Negative bool      `json:"negative"`
+	Answers  []string  `json:"answers,omitempty"`
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+	Hits     int       `json:"hits"`
+}
+
+// DNSCache is an LRU cache of upstream responses
+type DNSCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	lru     *list.List
+}
+
+var dnsCache = NewDNSCache()
+
+// NewDNSCache creates an empty cache
+func NewDNSCache() *DNSCache {
+	return &DNSCache{
+		entries: make(map[dnsCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// cacheKey identifies a query.  Answers to DNSSEC queries include
+// signatures, with checking disabled a validating resolver answers with
+// data that failed validation, and an answer to a query with a client
+// subnet (RFC 7871) may be tailored to that subnet, so each is cached
+// separately.
+func cacheKey(query *dns.Msg) dnsCacheKey {
+	q := query.Question[0]
+	key := dnsCacheKey{name: strings.ToLower(dns.Fqdn(q.Name)), qtype: q.Qtype, class: q.Qclass, cd: query.CheckingDisabled}
+
+	if opt := query.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				bits := 32
+				if subnet.Family == 2 {
+					bits = 128
+				}
+				prefix := &net.IPNet{IP: subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits)), Mask: net.CIDRMask(int(subnet.SourceNetmask), bits)}
+				key.ecs = prefix.String()
+			}
+		}
+	}
+
+	return key
+}
+
+// cacheTTL returns how long a response may be cached and whether it is
+// a negative answer.  A zero duration means it must not be cached.
+func cacheTTL(m *dns.Msg) (time.Duration, bool) {
+
+	if m.Truncated {
+		return 0, false
+	}
+
+	negative := m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+	if !negative {
+		if m.Rcode != dns.RcodeSuccess {
+			return 0, false
+		}
+		ttl := uint32(0)
+		for i, rr := range m.Answer {
+			if i == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		d := time.Duration(ttl) * time.Second
+		if d > dnsCacheMaxTTL {
+			d = dnsCacheMaxTTL
+		}
+		return d, false
+	}
+
+	// RFC 2308: the negative TTL is the smaller of the SOA's TTL and MINIMUM
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			d := time.Duration(ttl) * time.Second
+			if d > dnsCacheMaxNegative {
+				d = dnsCacheMaxNegative
+			}
+			return d, true
+		}
+	}
+
+	// Without an SOA negative answers are not cached
+	return 0, true
+}
+
+// Put caches a response to a query
+func (c *DNSCache) Put(query *dns.Msg, response *dns.Msg) {
+
+	if cfg.DNSCacheSize <= 0 || len(query.Question) == 0 {
+		return
+	}
+
+	ttl, negative := cacheTTL(response)
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		key:      cacheKey(query),
+		msg:      response.Copy(),
+		stored:   now,
+		expires:  now.Add(ttl),
+		negative: negative,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, found := c.entries[entry.key]; found {
+		c.lru.Remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > cfg.DNSCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
+
+// Get returns a cached response to a query with the TTLs counted down, or
+// nil if there is no live entry
+func (c *DNSCache) Get(query *dns.Msg) *dns.Msg {
+
+	if cfg.DNSCacheSize <= 0 || len(query.Question) == 0 {
+		return nil
+	}
+
+	key := cacheKey(query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	entry := e.Value.(*dnsCacheEntry)
+
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	entry.hits++
+
+	age := uint32(now.Sub(entry.stored) / time.Second)
+
+	m := entry.msg.Copy()
+	m.Id = query.Id
+	m.Question = query.Question
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl -= age
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+
+	return m
+}
+
+// Entries returns the live entries, optionally only those for name
+func (c *DNSCache) Entries(name string) []DNSCacheEntry {
+
+	if name != "" {
+		name = strings.ToLower(dns.Fqdn(name))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entries := []DNSCacheEntry{}
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*dnsCacheEntry)
+		if !now.Before(entry.expires) {
+			continue
+		}
+		if name != "" && entry.key.name != name {
+			continue
+		}
+		v := DNSCacheEntry{
+			Name:     entry.key.name,
+			Type:     dns.TypeToString[entry.key.qtype],
+			Class:    dns.ClassToString[entry.key.class],
+			Rcode:    dns.RcodeToString[entry.msg.Rcode],
+			Negative: entry.negative,
+			Stored:   entry.stored,
+			Expires:  entry.expires,
+			Hits:     entry.hits,
+		}
+		for _, rr := range entry.msg.Answer {
+			v.Answers = append(v.Answers, rr.String())
+		}
+		entries = append(entries, v)
+	}
+
+	return entries
+}
+
+// Delete removes the entries for name, either of one type or of every type
+// if qtype is zero.  It returns the number of entries removed.
+func (c *DNSCache) Delete(name string, qtype uint16) int {
+
+	name = strings.ToLower(dns.Fqdn(name))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for key, e := range c.entries {
+		if key.name == name && (qtype == 0 || key.qtype == qtype) {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+			count++
+		}
+	}
+
+	return count
+}
+
+// Flush empties the cache
+func (c *DNSCache) Flush() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	log.Infof("Flushing %d cached DNS entries", c.lru.Len())
+
+	c.entries = make(map[dnsCacheKey]*list.Element)
+	c.lru.Init()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// EDNS0 (RFC 6891) and DNSSEC flags.
+//
+// Upstream queries always carry an OPT record so resolvers can send large
+// answers.  Each reply is then fitted to what the client asked for: the OPT
+// record is echoed with our buffer size, AD is only kept for clients that
+// understand it, and UDP replies that don't fit are truncated with TC set
+// so the client retries over TCP.
+
+// ednsUDPSize is the largest UDP payload we send or ask for, the value
+// recommended by DNS flag day 2020 to avoid fragmentation
+const ednsUDPSize = 1232
+
+// ednsWriter fixes up every reply to a query before it is sent
+type ednsWriter struct {
+	dns.ResponseWriter
+	query *dns.Msg
+}
+
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	switch w.query.Question[0].Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		// zone transfers are TCP only and sent as is
+	default:
+		FinishReply(w.query, m, w.RemoteAddr().Network())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// UpstreamQuery returns a copy of a client's query to send to the
+// resolvers.  The client's DO bit and EDNS options, such as the client
+// subnet, are passed through.
+func UpstreamQuery(query *dns.Msg) *dns.Msg {
+
+	q := query.Copy()
+
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(ednsUDPSize, false)
+	} else {
+		opt.SetUDPSize(ednsUDPSize)
+		opt.SetVersion(0)
+	}
+
+	// ask for the validation status so it can be checked
+	if cfg.DNSRequireDNSSEC {
+		q.AuthenticatedData = true
+	}
+
+	return q
+}
+
+// FinishReply fits a reply to the client's query.  network is the
+// transport the query arrived on.
+func FinishReply(query *dns.Msg, m *dns.Msg, network string) {
+
+	// the upstream's OPT record is replaced with our own
+	extra := []dns.RR{}
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+
+	size := dns.MinMsgSize
+	do := false
+
+	if opt := query.IsEdns0(); opt != nil {
+		do = opt.Do()
+
+		reply := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		reply.SetUDPSize(ednsUDPSize)
+		reply.SetDo(do)
+		if opt.Version() != 0 {
+			m.Rcode = dns.RcodeBadVers
+			m.Answer = nil
+			m.Ns = nil
+			m.Extra = nil
+		}
+		m.Extra = append(m.Extra, reply)
+
+		size = int(opt.UDPSize())
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		if size > ednsUDPSize {
+			size = ednsUDPSize
+		}
+	}
+
+	// RFC 6840 5.8: only set AD for clients that asked for it
+	if !query.AuthenticatedData && !do {
+		m.AuthenticatedData = false
+	}
+
+	if network == "udp" {
+		m.Truncate(size)
+	}
+}
+
+// Validated returns true if a response may be used when validated answers
+// are required
+func Validated(m *dns.Msg) bool {
+	return !cfg.DNSRequireDNSSEC || m.AuthenticatedData
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// FailSafeState tracks the failover state machine for a single server.
+// Each Worker has its own, so an outage at one control plane only puts the
+// VPNs belonging to that server into failsafe.
+type FailSafeState struct {
+	mu sync.Mutex
+
+	enabled   bool      // the server is unreachable and failsafe is in effect
+	acted     bool      // failsafe has started or stopped a network
+	msgSent   bool      // the user has been notified for this episode
+	count     int       // consecutive failures talking to the server
+	threshold int       // failures allowed before failsafe is enabled
+	since     time.Time // when failsafe was enabled
+	lastError string    // most recent failure
+}
+
+// FailSafeStatus is the read-only view of a FailSafeState for the local API
+type FailSafeStatus struct {
+	Enabled   bool       `json:"enabled"`
+	Acted     bool       `json:"acted"`
+	Count     int        `json:"count"`
+	Threshold int        `json:"threshold"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// Threshold returns the number of failures allowed before failsafe is enabled
+func (f *FailSafeState) Threshold() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.threshold <= 0 {
+		return cfg.FailSafeThreshold
+	}
+	return f.threshold
+}
+
+// SetThreshold overrides the default threshold for this server.  Zero restores the default.
+func (f *FailSafeState) SetThreshold(threshold int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.threshold = threshold
+}
+
+// Failure records a failed call to the server and returns true if failsafe is now enabled
+func (f *FailSafeState) Failure(err error) bool {
+	threshold := f.Threshold()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.count++
+	if err != nil {
+		f.lastError = err.Error()
+	}
+
+	if f.count > threshold {
+		if !f.enabled {
+			f.since = time.Now()
+		}
+		f.enabled = true
+	}
+
+	return f.enabled
+}
+
+// Success records a successful call to the server, clearing the failsafe
+// state.  It returns true if failsafe had acted on any networks.
+func (f *FailSafeState) Success() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recovered := f.enabled && f.acted
+
+	f.enabled = false
+	f.acted = false
+	f.msgSent = false
+	f.count = 0
+	f.since = time.Time{}
+	f.lastError = ""
+
+	return recovered
+}
+
+// Enabled returns true if failsafe is in effect for this server
+func (f *FailSafeState) Enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.enabled
+}
+
+// SetActed records that failsafe started or stopped a network
+func (f *FailSafeState) SetActed() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.acted = true
+}
+
+// MessageSent returns true if the user has already been notified
+func (f *FailSafeState) MessageSent() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.msgSent
+}
+
+// SetMessageSent suppresses further notifications until failsafe clears
+func (f *FailSafeState) SetMessageSent() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.msgSent = true
+}
+
+// Status returns a copy of the current state
+func (f *FailSafeState) Status() FailSafeStatus {
+	threshold := f.Threshold()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := FailSafeStatus{
+		Enabled:   f.enabled,
+		Acted:     f.acted,
+		Count:     f.count,
+		Threshold: threshold,
+		LastError: f.lastError,
+	}
+	if f.enabled {
+		since := f.since
+		status.Since = &since
+	}
+
+	return status
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Conditional forwarding.
+//
+// Queries for a domain and the names below it can be sent to their own
+// resolvers instead of the normal tiers.  Rules come from the VPN's DNS
+// list, in the same form as dnsmasq:
+//
+//	/corp.example.com/10.0.0.53
+//	/corp.example.com/lab.example.com/tls://dns.example.com
+//
+// or from the local override file, one domain and its resolvers per line:
+//
+//	corp.example.com 10.0.0.53 10.0.0.54
+//
+// Rules in the override file replace those from the VPNs for the same
+// domain.  The longest matching domain wins.
+
+// IsForwardRule returns true if an entry in the DNS list is a forwarding rule
+func IsForwardRule(s string) bool {
+	return strings.HasPrefix(s, "/")
+}
+
+// parseForwardRule splits a /domain/.../resolver entry
+func parseForwardRule(s string) ([]string, string, bool) {
+
+	// the resolver may be a URL, so split off the domains from the left
+	// until the scheme or an address is reached
+	rest := strings.TrimPrefix(s, "/")
+	domains := []string{}
+	for {
+		domain, remainder, found := strings.Cut(rest, "/")
+		if !found || strings.HasSuffix(domain, ":") {
+			break
+		}
+		domains = append(domains, domain)
+		rest = remainder
+	}
+
+	if len(domains) == 0 || !IsUpstream(rest) {
+		return nil, "", false
+	}
+
+	for i := range domains {
+		domains[i] = normalizeForwardDomain(domains[i])
+		if domains[i] == "" {
+			return nil, "", false
+		}
+	}
+
+	return domains, rest, true
+}
+
+func normalizeForwardDomain(domain string) string {
+	domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return ""
+	}
+	return domain
+}
+
+// AddForwarder adds a resolver for a domain
+func (d *DNS) AddForwarder(domain string, resolver string) error {
+
+	upstream, err := GetUpstream(resolver)
+	if err != nil {
+		return err
+	}
+
+	d.Forwarders[domain] = removeDuplicateUpstreams(append(d.Forwarders[domain], upstream))
+
+	return nil
+}
+
+// AddForwardRule adds a /domain/.../resolver entry from a VPN's DNS list
+func (d *DNS) AddForwardRule(entry string) {
+
+	domains, resolver, ok := parseForwardRule(entry)
+	if !ok {
+		log.Errorf("Invalid DNS forwarding rule: %s", entry)
+		return
+	}
+
+	for _, domain := range domains {
+		if err := d.AddForwarder(domain, resolver); err != nil {
+			log.Errorf("Invalid resolver %s for %s: %v", resolver, domain, err)
+		}
+	}
+}
+
+// LoadForwardFile reads the local forwarding rules.  A missing file is
+// not an error.
+func LoadForwardFile(path string) (map[string][]*Upstream, error) {
+
+	var d DNS
+	d.Forwarders = make(map[string][]*Upstream)
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d.Forwarders, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if IsForwardRule(line) {
+			d.AddForwardRule(line)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		domain := normalizeForwardDomain(fields[0])
+		if domain == "" || len(fields) < 2 {
+			log.Errorf("Invalid DNS forwarding rule in %s: %s", path, line)
+			continue
+		}
+		for _, resolver := range fields[1:] {
+			if err := d.AddForwarder(domain, resolver); err != nil {
+				log.Errorf("Invalid resolver %s for %s: %v", resolver, domain, err)
+			}
+		}
+	}
+
+	return d.Forwarders, scanner.Err()
+}
+
+// Forwarder returns the domain and resolvers of the longest rule matching
+// a name, or nil if no rule matches
+func Forwarder(name string) (string, []*Upstream) {
+
+	if len(global.Forwarders) == 0 {
+		return "", nil
+	}
+
+	name = strings.ToLower(strings.Trim(name, "."))
+	for {
+		if resolvers, found := global.Forwarders[name]; found {
+			return name, resolvers
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return "", nil
+		}
+		name = parent
+	}
+}
+
+// ForwarderNames returns the forwarding rules as they appear in the
+// configuration, for the local API
+func ForwarderNames(forwarders map[string][]*Upstream) map[string][]string {
+	names := make(map[string][]string)
+	for domain, resolvers := range forwarders {
+		names[domain] = UpstreamNames(resolvers)
+	}
+	return names
+}
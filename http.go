@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/nettica-com/nettica-admin/model"
 	log "github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -79,7 +80,6 @@ func statsHandler(w http.ResponseWriter, req *http.Request) {
 		log.Error(err)
 	}
 
-	w.Header().Add("Access-Control-Allow-Origin", "*")
 	io.WriteString(w, stats)
 }
 
@@ -90,12 +90,8 @@ func keyHandler(w http.ResponseWriter, req *http.Request) {
 	log.Infof("keyHandler")
 	// /keys/
 
-	// add the headers here to pass preflight checks
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Allow-Methods", "*")
-
 	switch req.Method {
-	case "GET":
+	case "POST":
 		log.Infof("Method: %s", req.Method)
 		key := Key{}
 		wg, _ := wgtypes.GeneratePrivateKey()
@@ -106,17 +102,67 @@ func keyHandler(w http.ResponseWriter, req *http.Request) {
 
 	default:
 		log.Infof("Method: %s", req.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		io.WriteString(w, "")
 		log.Infof("Unknown method: %s", req.Method)
 	}
 
 }
 
+// keyAuditHandler reports the keys in the keystore and which of them no
+// VPN uses.  ?orphans=true lists only the orphans.  A DELETE removes the
+// orphans unused for ?days= days, cfg.KeyOrphanAge if not given.
+func keyAuditHandler(w http.ResponseWriter, req *http.Request) {
+	// /keys/audit
+
+	switch req.Method {
+	case "GET":
+		report, err := KeyAudit()
+		if err != nil {
+			log.Errorf("Error auditing keys: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if orphans, _ := strconv.ParseBool(req.URL.Query().Get("orphans")); orphans {
+			filtered := []KeyReport{}
+			for _, r := range report {
+				if r.Orphan {
+					filtered = append(filtered, r)
+				}
+			}
+			report = filtered
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	case "DELETE":
+		age := cfg.KeyOrphanAge
+		if days := req.URL.Query().Get("days"); days != "" {
+			n, err := strconv.Atoi(days)
+			if err != nil || n < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			age = time.Duration(n) * 24 * time.Hour
+		}
+		pruned, err := KeyPrune(age)
+		if err != nil {
+			log.Errorf("Error pruning keys: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pruned)
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
+	}
+}
+
 func ServiceHandler(w http.ResponseWriter, req *http.Request) {
-	// add the headers here to pass preflight checks
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Allow-Methods", "*")
-	w.Header().Add("Access-Control-Allow-Headers", "*")
 
 	// extract the net name from the url
 	parts := strings.Split(req.URL.Path, "/")
@@ -261,9 +307,6 @@ func ServiceHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func vpnHandler(w http.ResponseWriter, req *http.Request) {
-	// add the headers here to pass preflight checks
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Allow-Methods", "*")
 
 	// extract the net name from the url
 	parts := strings.Split(req.URL.Path, "/")
@@ -306,9 +349,6 @@ func vpnHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func deviceHandler(w http.ResponseWriter, req *http.Request) {
-	// add the headers here to pass preflight checks
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Allow-Methods", "*")
 
 	softDelete := false
 
@@ -386,11 +426,7 @@ func deviceHandler(w http.ResponseWriter, req *http.Request) {
 }
 
 func configHandler(w http.ResponseWriter, req *http.Request) {
-	// decode the GET request parameters and save them to the config
-
-	// add the headers here to pass preflight checks
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Allow-Methods", "*")
+	// decode the POST parameters and save them to the config
 
 	device := model.Device{}
 	device.Version = Version
@@ -405,9 +441,9 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 	device.ConferenceEnabled = boolPtr(true)
 
 	switch req.Method {
-	case "GET":
+	case "POST":
 		log.Infof("Method: %s configHandler", req.Method)
-		Srvr := req.URL.Query().Get("server")
+		Srvr := req.FormValue("server")
 		if Srvr == "undefined" {
 			Srvr = ""
 		}
@@ -432,7 +468,7 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		device.Id = req.URL.Query().Get("id")
+		device.Id = req.FormValue("id")
 		device.Id = Sanitize(device.Id)
 
 		if device.Id == "undefined" || !strings.HasPrefix(device.Id, "device-") {
@@ -443,11 +479,11 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		device.ApiKey = Sanitize(req.URL.Query().Get("apiKey"))
+		device.ApiKey = Sanitize(req.FormValue("apiKey"))
 		if device.ApiKey == "undefined" || !strings.HasPrefix(device.ApiKey, "device-api") {
 			device.ApiKey = ""
 		}
-		EZCode := Sanitize(req.URL.Query().Get("ezcode"))
+		EZCode := Sanitize(req.FormValue("ezcode"))
 		if EZCode == "undefined" || !strings.HasPrefix(EZCode, "ez-") {
 			EZCode = ""
 		}
@@ -455,34 +491,34 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 			device.Server = Srvr
 			device.EZCode = EZCode
 
-			CheckInterval, _ := strconv.ParseInt(req.URL.Query().Get("checkInterval"), 10, 0)
+			CheckInterval, _ := strconv.ParseInt(req.FormValue("checkInterval"), 10, 0)
 			if CheckInterval != 0 {
 				device.CheckInterval = CheckInterval
 			}
 
-			accountid := Sanitize(req.URL.Query().Get("accountid"))
+			accountid := Sanitize(req.FormValue("accountid"))
 			if accountid != "" && accountid != "undefined" {
 				device.AccountID = accountid
 			}
 
-			name := Sanitize(req.URL.Query().Get("name"))
+			name := Sanitize(req.FormValue("name"))
 			if name != "" {
 				device.Name = name
 			}
 
-			os := Sanitize(req.URL.Query().Get("os"))
+			os := Sanitize(req.FormValue("os"))
 			if os != "" {
 				device.OS = os
 			}
 
-			arch := Sanitize(req.URL.Query().Get("arch"))
+			arch := Sanitize(req.FormValue("arch"))
 			if arch != "" {
 				device.Architecture = arch
 			}
 
-			device.Logging = Sanitize(req.URL.Query().Get("logging"))
+			device.Logging = Sanitize(req.FormValue("logging"))
 
-			instanceid := Sanitize(req.URL.Query().Get("instanceid"))
+			instanceid := Sanitize(req.FormValue("instanceid"))
 			if instanceid != "" && instanceid != "undefined" {
 				device.InstanceID = instanceid
 			}
@@ -558,27 +594,9 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 
 					go w.StartServer()
 					go w.StartBackgroundRefreshService()
+					go w.StartPushService()
 
-					curTs := calculateCurrentTimestamp()
-
-					t := time.Unix(curTs, 0)
-					log.Debugf("current timestamp = %v (%s)", curTs, t.UTC())
-
-					for !s.Shutdown {
-						time.Sleep(1000 * time.Millisecond)
-						ts := time.Now()
-
-						if ts.Unix() >= curTs {
-
-							w.Context.Running <- true
-
-							curTs = calculateCurrentTimestamp()
-							curTs += w.Context.Config.Device.CheckInterval
-						}
-
-					}
-
-					w.Context.Running <- false
+					w.Poll()
 
 				}(server)
 
@@ -587,6 +605,13 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 		} else {
 			log.Error("Invalid config parameters")
 		}
+
+	default:
+		// Changing the server is never done with a GET, so a page can't
+		// do it with a link or an image
+		log.Errorf("Rejected %s configHandler", req.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
 	data, err := json.Marshal(device)
 	if err != nil {
@@ -597,22 +622,287 @@ func configHandler(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// failsafeHandler reports the failsafe state of every server.  A PATCH
+// with ?threshold=N overrides the failure threshold for a single server.
+func failsafeHandler(w http.ResponseWriter, req *http.Request) {
+	// /failsafe/[server]
+
+	parts := strings.Split(req.URL.Path, "/")
+	name := ""
+	if len(parts) > 2 {
+		name = CleanupName(parts[2])
+	}
+
+	ServersMutex.Lock()
+	servers := make([]*Server, 0, len(Servers))
+	for _, s := range servers {
+		servers = append(servers, s)
+	}
+	ServersMutex.Unlock()
+
+	switch req.Method {
+	case "GET":
+		states := make(map[string]FailSafeStatus)
+		for _, s := range servers {
+			if s.Worker == nil {
+				continue
+			}
+			if name != "" && CleanupName(s.Name) != name {
+				continue
+			}
+			states[s.Name] = s.Worker.failsafe.Status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+
+	case "PATCH":
+		threshold, err := strconv.Atoi(req.URL.Query().Get("threshold"))
+		if err != nil || threshold < 0 || name == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, s := range servers {
+			if s.Worker != nil && CleanupName(s.Name) == name {
+				log.Infof("FailSafe threshold for %s set to %d", s.Name, threshold)
+				s.Worker.failsafe.SetThreshold(threshold)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(s.Worker.failsafe.Status())
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
+	}
+}
+
+// backoffHandler reports how long each server's control plane and service
+// host calls are being held off.  A DELETE clears the backoff so the next
+// poll goes out immediately.
+func backoffHandler(w http.ResponseWriter, req *http.Request) {
+	// /backoff/[server]
+
+	parts := strings.Split(req.URL.Path, "/")
+	name := ""
+	if len(parts) > 2 {
+		name = CleanupName(parts[2])
+	}
+
+	type backoffStatus struct {
+		ControlPlane *BackoffStatus `json:"controlPlane,omitempty"`
+		ServiceHost  BackoffStatus  `json:"serviceHost"`
+	}
+
+	ServersMutex.Lock()
+	servers := make([]*Server, 0, len(Servers))
+	for _, s := range servers {
+		servers = append(servers, s)
+	}
+	ServersMutex.Unlock()
+
+	switch req.Method {
+	case "GET":
+		states := make(map[string]backoffStatus)
+		for _, s := range servers {
+			if name != "" && CleanupName(s.Name) != name {
+				continue
+			}
+			var state backoffStatus
+			if s.Worker != nil {
+				status := s.Worker.backoff.Status()
+				state.ControlPlane = &status
+			}
+			state.ServiceHost = s.ServiceBackoff.Status()
+			states[s.Name] = state
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(states)
+
+	case "DELETE":
+		found := false
+		for _, s := range servers {
+			if name != "" && CleanupName(s.Name) != name {
+				continue
+			}
+			found = true
+			if s.Worker != nil {
+				s.Worker.backoff.Success()
+			}
+			s.ServiceBackoff.Success()
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "")
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
+	}
+}
+
+// statusHandler returns the state of the daemon as JSON
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	// /status
+
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetStatus())
+}
+
+// dnsCacheHandler lists the cached DNS responses, optionally for a single
+// ?name=.  A DELETE removes the entries for ?name= (and ?type=), or
+// flushes the whole cache if no name is given.
+func dnsCacheHandler(w http.ResponseWriter, req *http.Request) {
+	// /dns/cache
+
+	name := req.URL.Query().Get("name")
+
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dnsCache.Entries(name))
+
+	case "DELETE":
+		if name == "" {
+			dnsCache.Flush()
+			io.WriteString(w, "")
+			return
+		}
+		var qtype uint16
+		if t := req.URL.Query().Get("type"); t != "" {
+			var found bool
+			qtype, found = dns.StringToType[strings.ToUpper(t)]
+			if !found {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		count := dnsCache.Delete(name, qtype)
+		log.Infof("Removed %d cached DNS entries for %s", count, name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"removed": count})
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
+	}
+}
+
+// dnsLogHandler returns the recent DNS queries, newest first.  They can be
+// filtered with ?name=, ?client=, ?type=, ?source=, ?rcode=, ?since= (RFC
+// 3339) and ?limit=.  A DELETE clears the log.
+func dnsLogHandler(w http.ResponseWriter, req *http.Request) {
+	// /dns/log
+
+	switch req.Method {
+	case "GET":
+		query := req.URL.Query()
+		filter := QueryLogFilter{
+			Name:   query.Get("name"),
+			Client: query.Get("client"),
+			Type:   query.Get("type"),
+			Source: query.Get("source"),
+			Rcode:  query.Get("rcode"),
+		}
+		if since := query.Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			filter.Since = t
+		}
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			filter.Limit = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(queryLog.Entries(filter))
+
+	case "DELETE":
+		queryLog.Clear()
+		io.WriteString(w, "")
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
+	}
+}
+
+// dnsBlocklistHandler lists the block and allow lists, or reports whether
+// ?name= is blocked.  A POST reloads the lists.
+func dnsBlocklistHandler(w http.ResponseWriter, req *http.Request) {
+	// /dns/blocklist
+
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		if name := req.URL.Query().Get("name"); name != "" {
+			json.NewEncoder(w).Encode(map[string]bool{"blocked": blocklist.Blocked(name)})
+			return
+		}
+		json.NewEncoder(w).Encode(blocklist.Status())
+
+	case "POST":
+		blocklist.Load()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blocklist.Status())
+
+	default:
+		io.WriteString(w, "")
+		log.Infof("Unknown method: %s", req.Method)
+	}
+}
+
 func boolPtr(b bool) *bool {
 	t := b
 	return &t
 }
 
 func startHTTPd() {
-	http.HandleFunc("/stats/", statsHandler)
-	http.HandleFunc("/keys/", keyHandler)
-	http.HandleFunc("/service/", ServiceHandler)
-	http.HandleFunc("/vpn/", vpnHandler)
-	http.HandleFunc("/device/", deviceHandler)
-	http.HandleFunc("/config/", configHandler)
+	http.HandleFunc("/stats/", authorize(statsHandler))
+	http.HandleFunc("/keys/", authorize(keyHandler))
+	http.HandleFunc("/keys/audit", authorize(keyAuditHandler))
+	http.HandleFunc("/service/", authorize(ServiceHandler))
+	http.HandleFunc("/vpn/", authorize(vpnHandler))
+	http.HandleFunc("/device/", authorize(deviceHandler))
+	http.HandleFunc("/config/", authorize(configHandler))
+	http.HandleFunc("/failsafe/", authorize(failsafeHandler))
+	http.HandleFunc("/backoff/", authorize(backoffHandler))
+	http.HandleFunc("/status", authorize(statusHandler))
+	http.HandleFunc("/metrics", authorize(metricsHandler))
+	http.HandleFunc("/dns/cache", authorize(dnsCacheHandler))
+	http.HandleFunc("/dns/blocklist", authorize(dnsBlocklistHandler))
+	http.HandleFunc("/dns/log", authorize(dnsLogHandler))
+
+	_, err := LoadAPIToken()
+	if err != nil {
+		log.Errorf("Error creating local API token: %v", err)
+	}
+
+	if cfg.MetricsAddress != "" {
+		go startMetrics(cfg.MetricsAddress)
+	}
+
+	if cfg.Socket != "" {
+		go StartSocket(cfg.Socket)
+	}
 
 	log.Infof("Starting web server on %s", "127.0.0.1:53280")
 
-	err := http.ListenAndServe("127.0.0.1:53280", nil)
+	err = http.ListenAndServe("127.0.0.1:53280", nil)
 	if err != nil {
 		log.Error(err)
 	}
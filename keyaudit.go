@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Key store audit.
+//
+// Keys are added for every new VPN and by POST /keys/, but nothing else
+// removes them when a VPN goes away.  KeyAudit compares the key store
+// with the public keys of the VPNs in every server's configuration.  A
+// key no VPN uses is an orphan, and KeyPrune deletes the orphans that
+// haven't been used for cfg.KeyOrphanAge.  Keys replaced by a rotation
+// are left to KeyCollect.
+
+// KeyReport describes a key in the key store, without the private key
+type KeyReport struct {
+	Public   string     `json:"public"`
+	Created  time.Time  `json:"created"`
+	Net      string     `json:"net,omitempty"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Retired  *time.Time `json:"retired,omitempty"`
+	InUse    bool       `json:"inUse"`
+	Orphan   bool       `json:"orphan"`
+}
+
+// configuredKeys returns the net of every public key in the servers'
+// configurations.  It fails if any configuration can't be read, since
+// every key would look like an orphan.
+func configuredKeys() (map[string]string, error) {
+
+	ServersMutex.Lock()
+	servers := make([]*Server, 0, len(Servers))
+	for _, s := range Servers {
+		servers = append(servers, s)
+	}
+	ServersMutex.Unlock()
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers are configured")
+	}
+
+	keys := make(map[string]string)
+	for _, s := range servers {
+		body := s.GetBody()
+		if len(body) == 0 {
+			return nil, fmt.Errorf("no configuration from %s yet", s.Name)
+		}
+
+		var msg model.Message
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("error reading configuration from %s: %v", s.Name, err)
+		}
+
+		for _, config := range msg.Config {
+			for _, vpn := range config.VPNs {
+				if vpn.Current.PublicKey != "" {
+					keys[vpn.Current.PublicKey] = config.NetName
+				}
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// KeyAudit reports every key in the key store and whether a VPN uses it
+func KeyAudit() ([]KeyReport, error) {
+
+	configured, err := configuredKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	report := make([]KeyReport, 0, len(KeyStore))
+	for public := range KeyStore {
+		r := KeyReport{Public: public}
+		if info, found := KeyMeta[public]; found {
+			r.Created = info.Created
+			r.Net = info.Net
+			r.LastUsed = info.LastUsed
+			r.Retired = info.Retired
+		}
+		if net, found := configured[public]; found {
+			r.InUse = true
+			if r.Net == "" {
+				r.Net = net
+			}
+		}
+		r.Orphan = !r.InUse && r.Retired == nil
+		report = append(report, r)
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Created.Before(report[j].Created)
+	})
+
+	return report, nil
+}
+
+// KeyPrune deletes the orphaned keys that haven't been created or used
+// for age, and returns them
+func KeyPrune(age time.Duration) ([]string, error) {
+
+	report, err := KeyAudit()
+	if err != nil {
+		return nil, err
+	}
+
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	pruned := []string{}
+	for _, r := range report {
+		if !r.Orphan {
+			continue
+		}
+		info, found := KeyMeta[r.Public]
+		if !found {
+			continue
+		}
+		// it may have been used since the audit
+		last := info.Created
+		if info.LastUsed != nil && info.LastUsed.After(last) {
+			last = *info.LastUsed
+		}
+		if time.Since(last) < age {
+			continue
+		}
+		log.Infof("Deleting orphaned key %s (net %s, created %s)", r.Public, r.Net, r.Created.Format(time.RFC3339))
+		delete(KeyStore, r.Public)
+		delete(KeyMeta, r.Public)
+		pruned = append(pruned, r.Public)
+	}
+
+	if len(pruned) > 0 {
+		if err := keySave(); err != nil {
+			return pruned, err
+		}
+	}
+
+	return pruned, nil
+}
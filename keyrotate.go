@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Key rotation.
+//
+// When the device manages its own keys (UpdateKeys), each VPN's key pair
+// is replaced once it is older than cfg.KeyRotationDays, or the days in a
+// keyrotate:<days> tag.  The new public key is sent to nettica, which
+// passes it on to the peers, and the running tunnel is given the new
+// private key in place.  The old private key is kept in the key store for
+// cfg.KeyGracePeriod, then KeyCollect deletes it.
+//
+// A net's preshared key is shared by all of its VPNs, so it can only be
+// replaced on every VPN at once.  The device with the lowest VPN id in
+// the net does it on the same schedule, and the peers pick the new key
+// up as a live peer change.  There is no grace period: a peer that hasn't
+// seen the new key yet can't complete a handshake until it polls.
+
+// KeyRotationDays returns how often a VPN's key pair is replaced, 0 for
+// never
+func KeyRotationDays(tags []string) int {
+	for _, tag := range tags {
+		if value, found := strings.CutPrefix(strings.ToLower(tag), "keyrotate:"); found {
+			if days, err := strconv.Atoi(value); err == nil && days >= 0 {
+				return days
+			}
+			log.Errorf("Invalid key rotation tag %s", tag)
+		}
+	}
+	return cfg.KeyRotationDays
+}
+
+// KeyRotationDue returns true if a key pair is older than days
+func KeyRotationDue(public string, days int) bool {
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	if days <= 0 {
+		return false
+	}
+	info, found := KeyMeta[public]
+	if !found || info.Retired != nil {
+		return false
+	}
+
+	return time.Since(info.Created) >= time.Duration(days)*24*time.Hour
+}
+
+// KeyRetire marks a key pair as replaced.  Its private key is kept until
+// the grace period ends.
+func KeyRetire(public string) {
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	if info, found := KeyMeta[public]; found && info.Retired == nil {
+		now := time.Now()
+		info.Retired = &now
+	}
+}
+
+// KeyCollect deletes the retired keys whose grace period has ended and
+// returns how many were deleted
+func KeyCollect() int {
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	count := 0
+	for public, info := range KeyMeta {
+		if info.Retired == nil || time.Since(*info.Retired) < cfg.KeyGracePeriod {
+			continue
+		}
+		delete(KeyStore, public)
+		delete(KeyMeta, public)
+		count++
+	}
+
+	if count > 0 {
+		log.Infof("Deleted %d retired keys", count)
+		keySave()
+	}
+
+	return count
+}
+
+// RotateKey gives a VPN a new key pair and tells nettica about it.  It
+// returns the new private key, or false if the server didn't take it, in
+// which case the VPN keeps its old key and the next pass tries again.
+func (w *Worker) RotateKey(vpn *model.VPN) (string, bool) {
+
+	wg, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		log.Errorf("Error generating key for %s: %v", vpn.Name, err)
+		return "", false
+	}
+
+	old := vpn.Current.PublicKey
+	public := wg.PublicKey().String()
+
+	// Save the new key before the server can hand it to the peers
+	KeyAdd(public, wg.String())
+	if err := KeySave(); err != nil {
+		KeyDelete(public)
+		return "", false
+	}
+
+	vpn.Current.PublicKey = public
+	vpn.Current.PrivateKey = ""
+	if err := w.UpdateVPN(vpn); err != nil {
+		log.Errorf("Error rotating key for %s: %v", vpn.Name, err)
+		vpn.Current.PublicKey = old
+		KeyDelete(public)
+		KeySave()
+		return "", false
+	}
+
+	KeyRetire(old)
+	KeySave()
+
+	log.Infof("Key rotated for %s", vpn.Name)
+
+	return wg.String(), true
+}
+
+// PSKInfo records when a net's preshared key was first seen.  Only a
+// fingerprint of the key is kept.
+type PSKInfo struct {
+	Fingerprint string    `json:"fingerprint"`
+	Seen        time.Time `json:"seen"`
+}
+
+// PSKMeta is the PSKInfo of each net, kept in keys.psk.  Guarded by
+// KeyLock.
+var PSKMeta map[string]*PSKInfo
+
+func pskFingerprint(psk string) string {
+	sum := sha256.Sum256([]byte(psk))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pskLoadMeta reads keys.psk the first time it's needed.  KeyLock must be
+// held.
+func pskLoadMeta() {
+
+	if PSKMeta != nil {
+		return
+	}
+	PSKMeta = make(map[string]*PSKInfo)
+
+	bytes, err := ReadFileSafe(GetDataPath()+"keys.psk", ValidJSON)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Error reading keys.psk: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(bytes, &PSKMeta); err != nil {
+		log.Errorf("Error unmarshalling keys.psk: %v", err)
+		PSKMeta = make(map[string]*PSKInfo)
+	}
+}
+
+// pskSaveMeta writes keys.psk.  KeyLock must be held.
+func pskSaveMeta() {
+
+	bytes, err := json.Marshal(PSKMeta)
+	if err != nil {
+		log.Errorf("Error marshalling json: %v", err)
+		return
+	}
+	if err := WriteFileAtomic(GetDataPath()+"keys.psk", bytes, 0600); err != nil {
+		log.Errorf("Error writing keys.psk: %v", err)
+	}
+}
+
+// pskSeen records a net's preshared key, restarting its age if it changed
+func pskSeen(netName string, psk string) *PSKInfo {
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	pskLoadMeta()
+
+	fingerprint := pskFingerprint(psk)
+	info, found := PSKMeta[netName]
+	if !found || info == nil || info.Fingerprint != fingerprint {
+		info = &PSKInfo{Fingerprint: fingerprint, Seen: time.Now()}
+		PSKMeta[netName] = info
+		pskSaveMeta()
+	}
+
+	return info
+}
+
+// PSKRotationDue returns true if this device should replace the net's
+// preshared key: it is older than days, and our VPN has the lowest id in
+// the net so only one device does it
+func PSKRotationDue(vpn *model.VPN, vpns []model.VPN, days int) bool {
+
+	psk := vpn.Current.PresharedKey
+	if psk == "" {
+		return false
+	}
+	info := pskSeen(vpn.NetName, psk)
+
+	if days <= 0 || time.Since(info.Seen) < time.Duration(days)*24*time.Hour {
+		return false
+	}
+	for _, peer := range vpns {
+		if peer.Id < vpn.Id {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RotatePSK gives every VPN in the net a new preshared key and tells
+// nettica about them.  If the server doesn't take one of them, the VPNs
+// already updated are put back and it returns false.
+func (w *Worker) RotatePSK(vpn *model.VPN, vpns []model.VPN) bool {
+
+	// The peers have had local subnets removed from their AllowedIPs, so
+	// send nettica the peers as it sent them to us
+	var msg model.Message
+	if err := json.Unmarshal(w.Context.GetBody(), &msg); err != nil {
+		log.Errorf("Error reading configuration for %s: %v", vpn.NetName, err)
+		return false
+	}
+	_, peers := FindDeviceVPN(&msg, vpn.NetName, w.Context.Config.Device.Id)
+	if len(peers) != len(vpns) {
+		return false
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		log.Errorf("Error generating preshared key for %s: %v", vpn.NetName, err)
+		return false
+	}
+	psk := key.String()
+	old := vpn.Current.PresharedKey
+
+	all := []*model.VPN{vpn}
+	for i := range peers {
+		all = append(all, &peers[i])
+	}
+
+	setPSK := func(v *model.VPN, from string, to string) {
+		v.Current.PresharedKey = to
+		if v.Default != nil && v.Default.PresharedKey == from {
+			v.Default.PresharedKey = to
+		}
+	}
+
+	for i, v := range all {
+		setPSK(v, old, psk)
+		if err := w.UpdateVPN(v); err != nil {
+			log.Errorf("Error rotating preshared key for %s on %s: %v", vpn.NetName, v.Name, err)
+			setPSK(v, psk, old)
+			for _, u := range all[:i] {
+				setPSK(u, psk, old)
+				if err := w.UpdateVPN(u); err != nil {
+					log.Errorf("Error restoring preshared key on %s: %v", u.Name, err)
+				}
+			}
+			return false
+		}
+	}
+
+	// the configuration we're about to write
+	for i := range vpns {
+		setPSK(&vpns[i], old, psk)
+	}
+	pskSeen(vpn.NetName, psk)
+
+	log.Infof("Preshared key rotated for %s", vpn.NetName)
+
+	return true
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted key store.
+//
+// keys.keys is sealed with XChaCha20-Poly1305 under a key-encryption key
+// (KEK) from one of these providers:
+//
+//	systemd-creds  the credential named cfg.KeystoreCredential, passed in
+//	               with LoadCredentialEncrypted= in the unit file
+//	keyring        a "user" key described as cfg.KeystoreKeyring in the
+//	               kernel keyring (Linux)
+//	passphrase     NETTICA_KEYSTORE_PASSPHRASE, or the contents of
+//	               NETTICA_KEYSTORE_PASSPHRASE_FILE, stretched with Argon2id
+//
+// cfg.KeystoreProvider selects one, or "auto" uses the first that is
+// available.  A plain JSON keys.keys is encrypted the first time it is
+// loaded with a provider available.  Without one the keys stay in plain
+// text as before.
+
+const keystoreVersion = 1
+
+// KEKProvider supplies the key that encrypts the key store
+type KEKProvider interface {
+	Name() string
+	Available() bool
+	Key(salt []byte) ([]byte, error)
+}
+
+// keystoreFile is the encrypted form of keys.keys
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	Provider   string `json:"provider"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// The KEK is derived once and reused for every save.  Guarded by KeyLock.
+var (
+	keystoreProvider KEKProvider
+	keystoreSalt     []byte
+	keystoreKEK      []byte
+
+	// why keys.keys is encrypted but could not be opened
+	keystoreUnreadable error
+)
+
+// KeystoreError returns the error that kept keys.keys from being
+// decrypted, or nil if the keys are available
+func KeystoreError() error {
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	return keystoreUnreadable
+}
+
+var kekProviders = []KEKProvider{
+	systemdCredsProvider{},
+	keyringProvider{},
+	passphraseProvider{},
+}
+
+// KeystoreProvider returns the configured provider, or nil if the key
+// store is not encrypted
+func KeystoreProvider() (KEKProvider, error) {
+
+	switch cfg.KeystoreProvider {
+	case "none":
+		return nil, nil
+	case "", "auto":
+		for _, p := range kekProviders {
+			if p.Available() {
+				return p, nil
+			}
+		}
+		return nil, nil
+	}
+
+	p := kekProviderByName(cfg.KeystoreProvider)
+	if p == nil {
+		return nil, fmt.Errorf("unknown keystore provider %s", cfg.KeystoreProvider)
+	}
+	if !p.Available() {
+		return nil, fmt.Errorf("keystore provider %s is not available", p.Name())
+	}
+	return p, nil
+}
+
+func kekProviderByName(name string) KEKProvider {
+	for _, p := range kekProviders {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func keystoreAAD(version int, provider string, salt []byte) []byte {
+	return append([]byte(fmt.Sprintf("nettica keystore v%d %s ", version, provider)), salt...)
+}
+
+// sealKeyStore encrypts the keys.  KeyLock must be held.
+func sealKeyStore(p KEKProvider, plaintext []byte) ([]byte, error) {
+
+	if keystoreProvider == nil || keystoreProvider.Name() != p.Name() || keystoreKEK == nil {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		kek, err := p.Key(salt)
+		if err != nil {
+			return nil, err
+		}
+		keystoreProvider, keystoreSalt, keystoreKEK = p, salt, kek
+	}
+
+	aead, err := chacha20poly1305.NewX(keystoreKEK)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := keystoreFile{
+		Version:    keystoreVersion,
+		Provider:   p.Name(),
+		Salt:       keystoreSalt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, keystoreAAD(keystoreVersion, p.Name(), keystoreSalt)),
+	}
+
+	return json.MarshalIndent(sealed, "", "  ")
+}
+
+// openKeyStore decrypts keys.keys, or returns it unchanged if it is plain
+// text.  It returns true if it was encrypted.  KeyLock must be held.
+func openKeyStore(data []byte) ([]byte, bool, error) {
+
+	var sealed keystoreFile
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.Ciphertext == nil {
+		return data, false, nil
+	}
+
+	if sealed.Version != keystoreVersion {
+		return nil, true, fmt.Errorf("unsupported keystore version %d", sealed.Version)
+	}
+	p := kekProviderByName(sealed.Provider)
+	if p == nil {
+		return nil, true, fmt.Errorf("unknown keystore provider %s", sealed.Provider)
+	}
+	if !p.Available() {
+		return nil, true, fmt.Errorf("keys.keys is encrypted with %s, which is not available", p.Name())
+	}
+
+	kek, err := p.Key(sealed.Salt)
+	if err != nil {
+		return nil, true, err
+	}
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return nil, true, errors.New("invalid keystore nonce")
+	}
+	plaintext, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, keystoreAAD(sealed.Version, sealed.Provider, sealed.Salt))
+	if err != nil {
+		return nil, true, errors.New("keys.keys can't be decrypted, the key-encryption key is wrong or the file is damaged")
+	}
+
+	keystoreProvider, keystoreSalt, keystoreKEK = p, sealed.Salt, kek
+
+	return plaintext, true, nil
+}
+
+// isSealedKeyStore returns true if keys.keys data is encrypted
+func isSealedKeyStore(data []byte) bool {
+	var sealed keystoreFile
+	return json.Unmarshal(data, &sealed) == nil && sealed.Ciphertext != nil
+}
+
+// sealKeyStoreBackup encrypts a plain text keys.keys.bak left from before
+// the key store was encrypted, so no copy of the keys stays readable.  If
+// it can't be encrypted it is deleted.  KeyLock must be held.
+func sealKeyStoreBackup(p KEKProvider) {
+
+	path := GetDataPath() + "keys.keys" + backupSuffix
+
+	data, err := os.ReadFile(path)
+	if err != nil || isSealedKeyStore(data) {
+		return
+	}
+
+	if json.Valid(data) {
+		if sealed, err := sealKeyStore(p, data); err == nil {
+			if err := writeFileAtomic(path, sealed, 0600); err == nil {
+				log.Infof("Encrypted %s", path)
+				return
+			}
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Errorf("Error removing plain text %s: %v", path, err)
+	} else {
+		log.Infof("Removed plain text %s", path)
+	}
+}
+
+// deriveKEK turns a secret with plenty of entropy into a KEK
+func deriveKEK(secret []byte, salt []byte) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty key-encryption secret")
+	}
+	return hkdf.Key(sha256.New, secret, salt, "nettica keystore", chacha20poly1305.KeySize)
+}
+
+// passphraseProvider stretches a passphrase from the environment or a file
+type passphraseProvider struct{}
+
+func (passphraseProvider) Name() string { return "passphrase" }
+
+func (passphraseProvider) secret() ([]byte, error) {
+	if value := os.Getenv("NETTICA_KEYSTORE_PASSPHRASE"); value != "" {
+		return []byte(value), nil
+	}
+	if path := os.Getenv("NETTICA_KEYSTORE_PASSPHRASE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+	return nil, errors.New("no keystore passphrase")
+}
+
+func (p passphraseProvider) Available() bool {
+	secret, err := p.secret()
+	return err == nil && len(secret) > 0
+}
+
+func (p passphraseProvider) Key(salt []byte) ([]byte, error) {
+	secret, err := p.secret()
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty keystore passphrase")
+	}
+	return argon2.IDKey(secret, salt, 3, 64*1024, 4, chacha20poly1305.KeySize), nil
+}
+
+// systemdCredsProvider reads a credential systemd decrypted for the service
+type systemdCredsProvider struct{}
+
+func (systemdCredsProvider) Name() string { return "systemd-creds" }
+
+func (systemdCredsProvider) path() string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, cfg.KeystoreCredential)
+}
+
+func (p systemdCredsProvider) Available() bool {
+	path := p.path()
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (p systemdCredsProvider) Key(salt []byte) ([]byte, error) {
+	path := p.path()
+	if path == "" {
+		return nil, errors.New("no systemd credentials directory")
+	}
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKEK(secret, salt)
+}
+
+// keyringProvider reads a key from the kernel keyring
+type keyringProvider struct{}
+
+func (keyringProvider) Name() string { return "keyring" }
+
+func (keyringProvider) Available() bool {
+	_, err := keyringSecret(cfg.KeystoreKeyring)
+	return err == nil
+}
+
+func (keyringProvider) Key(salt []byte) ([]byte, error) {
+	secret, err := keyringSecret(cfg.KeystoreKeyring)
+	if err != nil {
+		return nil, err
+	}
+	return deriveKEK(secret, salt)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// keyringSecret reads a "user" key from the process, session or user
+// keyring, eg. one added with
+//
+//	keyctl add user nettica:keystore "$(head -c 32 /dev/urandom | base64)" @u
+func keyringSecret(description string) ([]byte, error) {
+
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user", description, 0)
+	if err != nil {
+		id, err = unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", description, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:size], nil
+}
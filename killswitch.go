@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kill switch.
+//
+// A full tunnel VPN with the "killswitch" tag blocks every packet that
+// doesn't go through the tunnel while the tunnel is enabled, except for
+// the WireGuard traffic to its endpoints, loopback and the addresses in
+// cfg.KillSwitchAllow.  If the tunnel breaks, traffic stops instead of
+// leaking onto the local network.
+//
+// The rules are installed by StartWireguard and removed by StopWireguard,
+// so a tunnel that is stopped on purpose, by the user or by FailSafe,
+// doesn't leave the device without a network.
+
+var (
+	killSwitches     = make(map[string]bool)
+	killSwitchesLock sync.Mutex
+)
+
+// KillSwitchFromTags returns true if a VPN's tags turn on the kill switch
+func KillSwitchFromTags(tags []string) bool {
+	for _, tag := range tags {
+		if strings.EqualFold(tag, "killswitch") {
+			return true
+		}
+	}
+	return false
+}
+
+// KillSwitchEnabled returns true if a net should have a kill switch
+func KillSwitchEnabled(netName string) bool {
+	killSwitchesLock.Lock()
+	defer killSwitchesLock.Unlock()
+
+	return killSwitches[Sanitize(netName)]
+}
+
+// SetKillSwitch turns the kill switch for a net on or off.  A running
+// tunnel gets or loses its rules right away, otherwise they follow the
+// tunnel when it is started or stopped.
+func SetKillSwitch(netName string, enabled bool) {
+
+	netName = Sanitize(netName)
+
+	killSwitchesLock.Lock()
+	previous, found := killSwitches[netName]
+	killSwitches[netName] = enabled
+	killSwitchesLock.Unlock()
+
+	if found && previous == enabled {
+		return
+	}
+
+	if !enabled {
+		if found {
+			log.Infof("Kill switch disabled for %s", netName)
+		}
+		if err := DisableKillSwitch(netName); err != nil {
+			log.Errorf("Error removing kill switch for %s: %v", netName, err)
+		}
+		return
+	}
+
+	log.Infof("Kill switch enabled for %s", netName)
+	if running, _ := IsWireguardRunning(netName); running {
+		if err := EnableKillSwitch(netName); err != nil {
+			log.Errorf("Error installing kill switch for %s: %v", netName, err)
+		}
+	}
+}
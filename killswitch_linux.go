@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// killSwitchTable is the nftables table holding a net's rules
+func killSwitchTable(netName string) string {
+	return "nettica_" + strings.NewReplacer(".", "_", "-", "_", "=", "_", "+", "_").Replace(netName)
+}
+
+// runNft applies a ruleset atomically
+func runNft(ruleset string) error {
+
+	nft, err := exec.LookPath("nft")
+	if err != nil {
+		return fmt.Errorf("nftables is not installed: %v", err)
+	}
+
+	cmd := exec.Command(nft, "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v (%s)", err, strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
+
+// EnableKillSwitch installs the rules that only let traffic leave through
+// the tunnel.  Split tunnels are left alone.
+func EnableKillSwitch(netName string) error {
+
+	netName = Sanitize(netName)
+
+	conf, err := ReadWireguardConfig(netName)
+	if err != nil {
+		return err
+	}
+	if !hasDefaultRoute(conf) {
+		log.Infof("Kill switch for %s ignored, it is not a full tunnel", netName)
+		return nil
+	}
+
+	v4 := []string{}
+	v6 := []string{}
+	for _, allowed := range cfg.KillSwitchAllow {
+		ipnet, err := ParsePrefix(allowed)
+		if err != nil {
+			log.Errorf("Invalid kill switch exception %s: %v", allowed, err)
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			v4 = append(v4, ipnet.String())
+		} else {
+			v6 = append(v6, ipnet.String())
+		}
+	}
+
+	table := killSwitchTable(netName)
+
+	var rules strings.Builder
+	// declaring then deleting the table makes this replace any old rules
+	fmt.Fprintf(&rules, "table inet %s\n", table)
+	fmt.Fprintf(&rules, "delete table inet %s\n", table)
+	fmt.Fprintf(&rules, "table inet %s {\n", table)
+	fmt.Fprintf(&rules, "\tchain output {\n")
+	fmt.Fprintf(&rules, "\t\ttype filter hook output priority 0; policy drop;\n")
+	fmt.Fprintf(&rules, "\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&rules, "\t\toifname %s accept\n", strconv.Quote(netName))
+	// WireGuard marks its own packets when it is a full tunnel
+	if mark := wireguardMark(netName); mark != 0 {
+		fmt.Fprintf(&rules, "\t\tmeta mark %d accept\n", mark)
+	}
+
+	for _, peer := range conf.Peers {
+		if peer.Endpoint == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(peer.Endpoint)
+		if err != nil {
+			log.Errorf("Invalid endpoint %s: %v", peer.Endpoint, err)
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			log.Errorf("Error resolving endpoint %s: %v", host, err)
+			continue
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				fmt.Fprintf(&rules, "\t\tip daddr %s udp dport %s accept\n", ip, port)
+			} else {
+				fmt.Fprintf(&rules, "\t\tip6 daddr %s udp dport %s accept\n", ip, port)
+			}
+		}
+	}
+
+	if len(v4) > 0 {
+		fmt.Fprintf(&rules, "\t\tip daddr { %s } accept\n", strings.Join(v4, ", "))
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(&rules, "\t\tip6 daddr { %s } accept\n", strings.Join(v6, ", "))
+	}
+	fmt.Fprintf(&rules, "\t}\n")
+	fmt.Fprintf(&rules, "}\n")
+
+	if err := runNft(rules.String()); err != nil {
+		return err
+	}
+
+	log.Infof("Kill switch installed for %s", netName)
+
+	return nil
+}
+
+// DisableKillSwitch removes a net's rules if there are any
+func DisableKillSwitch(netName string) error {
+
+	table := killSwitchTable(Sanitize(netName))
+
+	if _, err := exec.LookPath("nft"); err != nil {
+		// without nftables there can't be any rules
+		return nil
+	}
+
+	return runNft(fmt.Sprintf("table inet %s\ndelete table inet %s\n", table, table))
+}
@@ -2,15 +2,26 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"errors"
 	"os"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// KeyInfo is what we know about a key pair other than the private key.
+// It is kept in keys.meta, which is not encrypted.
+type KeyInfo struct {
+	Created  time.Time  `json:"created"`
+	Net      string     `json:"net,omitempty"`      // the net the key was last used for
+	LastUsed *time.Time `json:"lastUsed,omitempty"` // last written to a WireGuard config
+	Retired  *time.Time `json:"retired,omitempty"`  // replaced by a newer key
+}
+
 var (
 	KeyStore map[string]string
+	KeyMeta  map[string]*KeyInfo
 	KeyLock  sync.Mutex
 )
 
@@ -19,6 +30,7 @@ func KeyInitialize() {
 	defer KeyLock.Unlock()
 
 	KeyStore = make(map[string]string)
+	KeyMeta = make(map[string]*KeyInfo)
 }
 
 func KeyLookup(key string) (string, bool) {
@@ -33,14 +45,39 @@ func KeyAdd(public string, private string) {
 	defer KeyLock.Unlock()
 
 	KeyStore[public] = private
+	if _, found := KeyMeta[public]; !found {
+		KeyMeta[public] = &KeyInfo{Created: time.Now()}
+	}
 
 }
 
+// KeyUse records that a key is the one in use for a net
+func KeyUse(public string, net string) {
+	KeyLock.Lock()
+	defer KeyLock.Unlock()
+
+	info, found := KeyMeta[public]
+	if !found {
+		return
+	}
+	// keys.meta only needs to be roughly up to date
+	save := info.Net != net || info.LastUsed == nil || time.Since(*info.LastUsed) > 24*time.Hour
+
+	now := time.Now()
+	info.Net = net
+	info.LastUsed = &now
+
+	if save {
+		keySaveMeta()
+	}
+}
+
 func KeyDelete(key string) {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
 	delete(KeyStore, key)
+	delete(KeyMeta, key)
 }
 
 func KeySave() error {
@@ -48,44 +85,166 @@ func KeySave() error {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	file, err := os.OpenFile(GetDataPath()+"keys.keys", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if file != nil {
-		defer file.Close()
+	return keySave()
+}
+
+// keySave writes the key store, encrypted if there is a provider for the
+// key-encryption key.  KeyLock must be held.
+func keySave() error {
+
+	// Don't replace keys we couldn't decrypt with new ones
+	if keystoreUnreadable != nil {
+		err := errors.New("keys.keys could not be decrypted, not overwriting it")
+		log.Errorf("Error saving keys: %v", err)
+		return err
 	}
+
+	bytes, err := json.Marshal(KeyStore)
 	if err != nil {
-		log.Errorf("Error opening keys.keys for write: %v", err)
+		log.Errorf("Error marshalling json: %v", err)
 		return err
 	}
-	bytes, err := json.Marshal(KeyStore)
+
+	provider, err := KeystoreProvider()
+	if err != nil {
+		// never fall back to writing the keys in plain text
+		log.Errorf("Error encrypting keys.keys: %v", err)
+		return err
+	}
+	if provider != nil {
+		bytes, err = sealKeyStore(provider, bytes)
+		if err != nil {
+			log.Errorf("Error encrypting keys.keys: %v", err)
+			return err
+		}
+	}
+
+	// Never let plain text keys become the backup of an encrypted store,
+	// or the other way round
+	sealed := isSealedKeyStore(bytes)
+	err = WriteFileAtomicBackup(GetDataPath()+"keys.keys", bytes, 0600, func(old []byte) bool {
+		return json.Valid(old) && isSealedKeyStore(old) == sealed
+	})
+	if err != nil {
+		log.Errorf("Error writing keys.keys: %v", err)
+		return err
+	}
+	if sealed {
+		sealKeyStoreBackup(provider)
+	}
+
+	return keySaveMeta()
+}
+
+// keySaveMeta writes keys.meta.  KeyLock must be held.
+func keySaveMeta() error {
+
+	bytes, err := json.MarshalIndent(KeyMeta, "", "  ")
 	if err != nil {
 		log.Errorf("Error marshalling json: %v", err)
+		return err
+	}
+
+	err = WriteFileAtomic(GetDataPath()+"keys.meta", bytes, 0600)
+	if err != nil {
+		log.Errorf("Error writing keys.meta: %v", err)
 	}
-	_, err = file.Write(bytes)
 
 	return err
 }
 
+// keyLoadMeta reads keys.meta.  Keys without metadata are treated as new,
+// so a rotation policy starts counting from the first time they are seen.
+// KeyLock must be held.
+func keyLoadMeta() {
+
+	meta := make(map[string]*KeyInfo)
+
+	bytes, err := ReadFileSafe(GetDataPath()+"keys.meta", ValidJSON)
+	if err == nil {
+		err = json.Unmarshal(bytes, &meta)
+		if err != nil {
+			log.Errorf("Error unmarshalling keys.meta: %v", err)
+			meta = make(map[string]*KeyInfo)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Error reading keys.meta: %v", err)
+	}
+
+	for public := range meta {
+		if _, found := KeyStore[public]; !found || meta[public] == nil {
+			delete(meta, public)
+		}
+	}
+	for public := range KeyStore {
+		if _, found := meta[public]; !found {
+			meta[public] = &KeyInfo{Created: time.Now()}
+		}
+	}
+
+	KeyMeta = meta
+}
+
 func KeyLoad() error {
 	KeyLock.Lock()
 	defer KeyLock.Unlock()
 
-	file, err := os.Open(GetDataPath() + "keys.keys")
-	if err != nil {
-		log.Errorf("Error opening keys.keys for read: %v", err)
+	// A backup must be in the same format as keys.keys, so an old plain
+	// text copy can't take the place of an encrypted key store.  If
+	// keys.keys is too damaged to tell, the backup's own format decides:
+	// keySave never keeps a backup in the other format, and
+	// sealKeyStoreBackup encrypts or removes a plain text one.
+	path := GetDataPath() + "keys.keys"
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error reading keys.keys: %v", err)
 		return err
 	}
+	sealed := isSealedKeyStore(current)
+	if !json.Valid(current) {
+		backup, err := os.ReadFile(path + backupSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error reading keys.keys%s: %v", backupSuffix, err)
+			return err
+		}
+		sealed = isSealedKeyStore(backup)
+	}
 
-	bytes, err := io.ReadAll(file)
-	file.Close()
-
+	bytes, err := ReadFileSafe(path, func(data []byte) error {
+		if err := ValidJSON(data); err != nil {
+			return err
+		}
+		if isSealedKeyStore(data) != sealed {
+			return errors.New("keys.keys.bak is not in the same format as keys.keys")
+		}
+		return nil
+	})
 	if err != nil {
 		log.Errorf("Error reading keys.keys: %v", err)
 		return err
 	}
 
+	bytes, encrypted, err := openKeyStore(bytes)
+	keystoreUnreadable = err
+	if err != nil {
+		log.Errorf("Error decrypting keys.keys: %v", err)
+		return err
+	}
+
 	err = json.Unmarshal(bytes, &KeyStore)
 	if err != nil {
 		log.Errorf("Error unmarshalling json: %v", err)
+		return err
+	}
+
+	keyLoadMeta()
+
+	// Encrypt a plain text key store as soon as there is a KEK for it
+	if !encrypted {
+		if provider, _ := KeystoreProvider(); provider != nil {
+			log.Infof("Encrypting keys.keys with %s", provider.Name())
+			err = keySave()
+		}
 	}
 
 	return err
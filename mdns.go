@@ -0,0 +1,456 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// mDNS bridge.
+//
+// A VPN with the "mdns" tag bridges multicast DNS on the device's LAN and
+// the mesh:
+//
+//   - services and hosts advertised on the LAN, eg. printer.local, are
+//     imported into the mesh zone under the VPN's name, so they resolve as
+//     printer.<vpn> from anywhere in the network.  Other DNS servers in the
+//     network forward queries for <vpn> to this one.
+//   - mDNS queries on the LAN for <peer>.local are answered with the
+//     addresses of the mesh peers, and so are unicast queries for them.
+//
+// The LAN's subnet must be routed over the mesh for the imported addresses
+// to be reachable.  Only IPv4 multicast is used.
+
+const (
+	mdnsBrowseInterval = 60 * time.Second
+	mdnsTTL            = 120
+	mdnsServices       = "_services._dns-sd._udp.local."
+	mdnsCacheFlush     = 1 << 15
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type mdnsRecord struct {
+	rr      dns.RR
+	expires time.Time
+}
+
+// MDNSBridge imports records from mDNS and answers mDNS queries for the
+// mesh
+type MDNSBridge struct {
+	mu      sync.Mutex
+	sites   map[string]string // our name in each bridged network.  key is the network name
+	learned map[string]*mdnsRecord
+	queried map[string]time.Time
+	zone    *Zone
+	conns   []*net.UDPConn
+	stop    chan bool
+}
+
+var mdnsBridge = &MDNSBridge{
+	sites:   make(map[string]string),
+	learned: make(map[string]*mdnsRecord),
+	queried: make(map[string]time.Time),
+	zone:    NewZone(),
+}
+
+// BridgeFromTags returns true if a VPN's tags turn on the mDNS bridge
+func BridgeFromTags(tags []string) bool {
+	for _, tag := range tags {
+		if strings.EqualFold(tag, "mdns") {
+			return true
+		}
+	}
+	return false
+}
+
+// Configure sets the networks to bridge, starting or stopping the bridge
+// as needed
+func (b *MDNSBridge) Configure(sites map[string]string) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sites = make(map[string]string)
+	for netName, site := range sites {
+		b.sites[netName] = site
+	}
+	b.rebuild()
+
+	if len(b.sites) == 0 {
+		if b.stop != nil {
+			log.Infof("Stopping mDNS bridge")
+			close(b.stop)
+			b.stop = nil
+			for _, conn := range b.conns {
+				conn.Close()
+			}
+			b.conns = nil
+			b.learned = make(map[string]*mdnsRecord)
+			b.rebuild()
+		}
+		return
+	}
+
+	if b.stop != nil {
+		return
+	}
+
+	interfaces := []*net.Interface{nil}
+	if len(cfg.MDNSInterfaces) > 0 {
+		interfaces = []*net.Interface{}
+		for _, name := range cfg.MDNSInterfaces {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				log.Errorf("mDNS interface %s: %v", name, err)
+				continue
+			}
+			interfaces = append(interfaces, iface)
+		}
+	}
+
+	for _, iface := range interfaces {
+		conn, err := net.ListenMulticastUDP("udp4", iface, mdnsGroup)
+		if err != nil {
+			log.Errorf("Error listening for mDNS: %v", err)
+			continue
+		}
+		b.conns = append(b.conns, conn)
+		go b.receive(conn)
+	}
+	if len(b.conns) == 0 {
+		return
+	}
+
+	log.Infof("Starting mDNS bridge for %v", b.sites)
+
+	b.stop = make(chan bool)
+	go b.browse(b.stop, b.conns)
+}
+
+// browse periodically asks the LAN which services it has
+func (b *MDNSBridge) browse(stop chan bool, conns []*net.UDPConn) {
+
+	for {
+		b.query(conns, mdnsServices, dns.TypePTR)
+		b.expire()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(mdnsBrowseInterval):
+		}
+	}
+}
+
+// query sends an mDNS question, at most once per browse interval
+func (b *MDNSBridge) query(conns []*net.UDPConn, name string, qtype uint16) {
+
+	key := strings.ToLower(name) + "/" + dns.TypeToString[qtype]
+
+	b.mu.Lock()
+	if last, found := b.queried[key]; found && time.Since(last) < mdnsBrowseInterval/2 {
+		b.mu.Unlock()
+		return
+	}
+	b.queried[key] = time.Now()
+	b.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Id = 0
+	m.RecursionDesired = false
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+
+	for _, conn := range conns {
+		if _, err := conn.WriteToUDP(packed, mdnsGroup); err != nil {
+			log.Debugf("Error sending mDNS query: %v", err)
+		}
+	}
+}
+
+// receive handles the mDNS packets arriving on a connection until it is
+// closed
+func (b *MDNSBridge) receive(conn *net.UDPConn) {
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		m := new(dns.Msg)
+		if err := m.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		if m.Response {
+			b.learn(conn, append(m.Answer, m.Extra...))
+		} else {
+			b.respond(conn, from, m)
+		}
+	}
+}
+
+// learn stores the records in an mDNS response
+func (b *MDNSBridge) learn(conn *net.UDPConn, rrs []dns.RR) {
+
+	services := []string{}
+
+	b.mu.Lock()
+
+	changed := false
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		hdr.Class &^= mdnsCacheFlush
+		if !strings.HasSuffix(strings.ToLower(hdr.Name), ".local.") {
+			continue
+		}
+		// don't import our own answers for the mesh peers
+		if b.peerLocked(hdr.Name) != nil {
+			continue
+		}
+
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA, *dns.PTR, *dns.SRV, *dns.TXT, *dns.CNAME:
+		default:
+			continue
+		}
+
+		ttl := hdr.Ttl
+		hdr.Ttl = 0
+		key := rr.String()
+
+		if ttl == 0 {
+			// goodbye packet
+			if _, found := b.learned[key]; found {
+				delete(b.learned, key)
+				changed = true
+			}
+			continue
+		}
+
+		if _, found := b.learned[key]; !found {
+			changed = true
+		}
+		hdr.Ttl = ttl
+		b.learned[key] = &mdnsRecord{rr: rr, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+
+		if ptr, ok := rr.(*dns.PTR); ok && strings.EqualFold(hdr.Name, mdnsServices) {
+			services = append(services, ptr.Ptr)
+		}
+	}
+
+	if changed {
+		b.rebuild()
+	}
+
+	b.mu.Unlock()
+
+	// ask for the instances of every service type
+	for _, service := range services {
+		b.query([]*net.UDPConn{conn}, service, dns.TypePTR)
+	}
+}
+
+// expire removes the records whose TTL has run out
+func (b *MDNSBridge) expire() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	changed := false
+	for key, record := range b.learned {
+		if now.After(record.expires) {
+			delete(b.learned, key)
+			changed = true
+		}
+	}
+	if changed {
+		b.rebuild()
+	}
+}
+
+// rebuild recreates the zone of imported records from the learned ones
+func (b *MDNSBridge) rebuild() {
+
+	zone := NewZone()
+	for _, site := range b.sites {
+		for _, record := range b.learned {
+			if rr := importRecord(record.rr, site); rr != nil {
+				zone.Add(rr)
+			}
+		}
+	}
+	b.zone = zone
+}
+
+// localToSite moves a name from .local to below a VPN's name
+func localToSite(name string, site string) (string, bool) {
+	if !strings.HasSuffix(strings.ToLower(name), ".local.") {
+		return "", false
+	}
+	return name[:len(name)-len("local.")] + site + ".", true
+}
+
+// importRecord returns a copy of an mDNS record for the mesh zone, or nil
+// if it can't be used from the mesh
+func importRecord(rr dns.RR, site string) dns.RR {
+
+	rr = dns.Copy(rr)
+	hdr := rr.Header()
+
+	var ok bool
+	if hdr.Name, ok = localToSite(hdr.Name, site); !ok {
+		return nil
+	}
+	if hdr.Ttl > zoneDefaultTTL {
+		hdr.Ttl = zoneDefaultTTL
+	}
+
+	switch v := rr.(type) {
+	case *dns.A:
+		ok = v.A.IsGlobalUnicast()
+	case *dns.AAAA:
+		ok = v.AAAA.IsGlobalUnicast()
+	case *dns.PTR:
+		v.Ptr, ok = localToSite(v.Ptr, site)
+	case *dns.SRV:
+		v.Target, ok = localToSite(v.Target, site)
+	case *dns.CNAME:
+		v.Target, ok = localToSite(v.Target, site)
+	case *dns.TXT:
+		ok = true
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil
+	}
+
+	return rr
+}
+
+// peerLocked returns the addresses of the mesh peer a .local name refers
+// to in any bridged network.  b.mu must be held.
+func (b *MDNSBridge) peerLocked(name string) []dns.RR {
+
+	zone := global.Zone
+	if zone == nil || !strings.HasSuffix(strings.ToLower(name), ".local.") {
+		return nil
+	}
+	label := name[:len(name)-len(".local.")]
+	if label == "" || strings.Contains(label, ".") {
+		return nil
+	}
+
+	for netName := range b.sites {
+		peer := label + "." + netName
+		rrs := append(zone.get(peer, dns.TypeA), zone.get(peer, dns.TypeAAAA)...)
+		if len(rrs) > 0 {
+			return rrs
+		}
+	}
+
+	return nil
+}
+
+// peerAnswer answers a question for a mesh peer's .local name
+func (b *MDNSBridge) peerAnswer(q dns.Question) []dns.RR {
+
+	b.mu.Lock()
+	rrs := b.peerLocked(q.Name)
+	b.mu.Unlock()
+
+	answer := []dns.RR{}
+	for _, rr := range rrs {
+		if q.Qtype != dns.TypeANY && q.Qtype != rr.Header().Rrtype {
+			continue
+		}
+		rr.Header().Name = q.Name
+		rr.Header().Ttl = mdnsTTL
+		answer = append(answer, rr)
+	}
+
+	return answer
+}
+
+// respond answers mDNS questions on the LAN for mesh peers
+func (b *MDNSBridge) respond(conn *net.UDPConn, from *net.UDPAddr, query *dns.Msg) {
+
+	m := new(dns.Msg)
+	m.Response = true
+	m.Authoritative = true
+
+	unicast := false
+	for _, q := range query.Question {
+		answer := b.peerAnswer(q)
+		if len(answer) == 0 {
+			continue
+		}
+		if q.Qclass&mdnsCacheFlush != 0 {
+			unicast = true
+		}
+		for _, rr := range answer {
+			// the names are unique to us
+			rr.Header().Class = dns.ClassINET | mdnsCacheFlush
+		}
+		m.Answer = append(m.Answer, answer...)
+	}
+	if len(m.Answer) == 0 {
+		return
+	}
+
+	to := mdnsGroup
+	if from.Port != mdnsGroup.Port {
+		// legacy unicast query, RFC 6762 6.7
+		m.Id = query.Id
+		m.Question = query.Question
+		for _, rr := range m.Answer {
+			rr.Header().Class = dns.ClassINET
+		}
+		to = from
+	} else if unicast {
+		to = from
+	}
+
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	if _, err := conn.WriteToUDP(packed, to); err != nil {
+		log.Debugf("Error sending mDNS response: %v", err)
+	}
+}
+
+// Answer answers a unicast question from the imported records, or for
+// the .local name of a mesh peer.  It returns false if the name is not
+// known to the bridge.
+func (b *MDNSBridge) Answer(q dns.Question) ([]dns.RR, []dns.RR, bool) {
+
+	if answer := b.peerAnswer(q); len(answer) > 0 {
+		return answer, nil, true
+	}
+
+	b.mu.Lock()
+	zone := b.zone
+	b.mu.Unlock()
+
+	return zone.Answer(q)
+}
+
+// Len returns the number of names imported from mDNS
+func (b *MDNSBridge) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.zone.Len()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// Prometheus metrics in the text exposition format.
+//
+// Counters and summaries are kept in a small registry and updated as
+// events happen.  Tunnel and conference figures are gauges that are read
+// when the endpoint is scraped.
+
+type metricFamily struct {
+	help   string
+	kind   string
+	values map[string]float64 // key is the rendered label set
+}
+
+type metricRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+var metrics = &metricRegistry{families: make(map[string]*metricFamily)}
+
+var metricHelp = map[string][2]string{
+	"nettica_dns_queries_total":                   {"counter", "DNS queries answered, by type, response code and source."},
+	"nettica_dns_upstream_duration_seconds":       {"summary", "Time taken by upstream resolvers to answer."},
+	"nettica_dns_upstream_errors_total":           {"counter", "Queries to upstream resolvers that failed."},
+	"nettica_control_plane_polls_total":           {"counter", "Polls of the control plane, by result."},
+	"nettica_control_plane_poll_duration_seconds": {"summary", "Time taken to poll the control plane."},
+}
+
+// Add adds value to the series of a counter or gauge
+func (m *metricRegistry) Add(name string, labels string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.family(name).values[labels] += value
+}
+
+// Observe records a duration for a summary
+func (m *metricRegistry) Observe(name string, labels string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f := m.family(name)
+	f.values[labels+"_sum"] += d.Seconds()
+	f.values[labels+"_count"]++
+}
+
+func (m *metricRegistry) family(name string) *metricFamily {
+	f, found := m.families[name]
+	if !found {
+		desc := metricHelp[name]
+		f = &metricFamily{kind: desc[0], help: desc[1], values: make(map[string]float64)}
+		m.families[name] = f
+	}
+	return f
+}
+
+// Write renders every family in the registry
+func (m *metricRegistry) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := m.families[name]
+		writeHeader(w, name, f.kind, f.help)
+
+		keys := make([]string, 0, len(f.values))
+		for key := range f.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := name
+			labels := key
+			if f.kind == "summary" {
+				if strings.HasSuffix(key, "_sum") {
+					series, labels = name+"_sum", strings.TrimSuffix(key, "_sum")
+				} else {
+					series, labels = name+"_count", strings.TrimSuffix(key, "_count")
+				}
+			}
+			writeSample(w, series, labels, f.values[key])
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	}
+	if kind == "" {
+		kind = "untyped"
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels string, value float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%s{%s} %v\n", name, labels, value)
+	} else {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+	}
+}
+
+// Labels renders name/value pairs as a Prometheus label set
+func Labels(pairs ...string) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(&sb, "%s=\"%s\"", pairs[i], value)
+	}
+	return sb.String()
+}
+
+// dnsRecorder captures the response code and where the answer came from
+// so handleQueries can count each query once
+type dnsRecorder struct {
+	dns.ResponseWriter
+	rcode  int
+	source string
+}
+
+func (r *dnsRecorder) WriteMsg(m *dns.Msg) error {
+	r.rcode = m.Rcode
+	return r.ResponseWriter.WriteMsg(m)
+}
+
+// SetQuerySource records where the answer to a query came from
+func SetQuerySource(w dns.ResponseWriter, source string) {
+	if r, ok := w.(*dnsRecorder); ok {
+		r.source = source
+	}
+}
+
+// CountQuery records a query answered by handleQueries
+func CountQuery(r *dnsRecorder, qtype uint16) {
+	rcode := "NONE"
+	if r.rcode >= 0 {
+		rcode = dns.RcodeToString[r.rcode]
+	}
+	metrics.Add("nettica_dns_queries_total", Labels("type", dns.TypeToString[qtype], "rcode", rcode, "source", r.source), 1)
+}
+
+// peerName identifies a WireGuard key by the VPN it belongs to
+type peerName struct {
+	net  string
+	name string
+}
+
+// knownKeys maps public keys from every server's configuration to VPNs
+func knownKeys() map[string]peerName {
+
+	keys := make(map[string]peerName)
+
+	ServersMutex.Lock()
+	servers := make([]*Server, 0, len(Servers))
+	for _, s := range Servers {
+		servers = append(servers, s)
+	}
+	ServersMutex.Unlock()
+
+	for _, s := range servers {
+		var msg model.Message
+		err := json.NewDecoder(bytes.NewReader(s.GetBody())).Decode(&msg)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < len(msg.Config); i++ {
+			for j := 0; j < len(msg.Config[i].VPNs); j++ {
+				vpn := msg.Config[i].VPNs[j]
+				keys[vpn.Current.PublicKey] = peerName{net: vpn.NetName, name: vpn.Name}
+			}
+		}
+	}
+
+	return keys
+}
+
+// writeWireguardMetrics reports per-peer traffic and handshake age
+func writeWireguardMetrics(w io.Writer) {
+
+	client, err := wgctrl.New()
+	if err != nil {
+		log.Debugf("Error opening wgctrl: %v", err)
+		return
+	}
+	defer client.Close()
+
+	devices, err := client.Devices()
+	if err != nil {
+		log.Debugf("Error listing WireGuard devices: %v", err)
+		return
+	}
+
+	keys := knownKeys()
+	now := time.Now()
+
+	var rx, tx, handshake bytes.Buffer
+	for _, dev := range devices {
+		net := keys[dev.PublicKey.String()].net
+		for _, p := range dev.Peers {
+			key := p.PublicKey.String()
+			labels := Labels("interface", dev.Name, "net", net, "peer", keys[key].name, "public_key", key)
+			writeSample(&rx, "nettica_wireguard_peer_receive_bytes_total", labels, float64(p.ReceiveBytes))
+			writeSample(&tx, "nettica_wireguard_peer_transmit_bytes_total", labels, float64(p.TransmitBytes))
+			if !p.LastHandshakeTime.IsZero() {
+				writeSample(&handshake, "nettica_wireguard_peer_last_handshake_age_seconds", labels, now.Sub(p.LastHandshakeTime).Seconds())
+			}
+		}
+	}
+
+	writeHeader(w, "nettica_wireguard_peer_receive_bytes_total", "counter", "Bytes received from a peer.")
+	w.Write(rx.Bytes())
+	writeHeader(w, "nettica_wireguard_peer_transmit_bytes_total", "counter", "Bytes sent to a peer.")
+	w.Write(tx.Bytes())
+	writeHeader(w, "nettica_wireguard_peer_last_handshake_age_seconds", "gauge", "Seconds since the last handshake with a peer.")
+	w.Write(handshake.Bytes())
+}
+
+// writeConferenceMetrics reports the active conference rooms and peers
+func writeConferenceMetrics(w io.Writer) {
+
+	conference.mu.RLock()
+	rooms := len(conference.rooms)
+	peers := 0
+	for _, r := range conference.rooms {
+		r.mu.RLock()
+		peers += len(r.peers)
+		r.mu.RUnlock()
+	}
+	conference.mu.RUnlock()
+
+	writeHeader(w, "nettica_conference_rooms", "gauge", "Active conference rooms.")
+	writeSample(w, "nettica_conference_rooms", "", float64(rooms))
+	writeHeader(w, "nettica_conference_peers", "gauge", "Peers connected to conference rooms.")
+	writeSample(w, "nettica_conference_peers", "", float64(peers))
+}
+
+// metricsHandler returns every metric in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	// /metrics
+
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metrics.Write(w)
+	writeWireguardMetrics(w)
+	writeConferenceMetrics(w)
+}
+
+// startMetrics serves /metrics on its own address, so it can be scraped
+// from outside without exposing the rest of the local API
+func startMetrics(address string) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	log.Infof("Starting metrics server on %s", address)
+
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Error(err)
+	}
+}
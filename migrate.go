@@ -62,7 +62,7 @@ func Migrate() {
 			if err != nil {
 				log.Errorf("Failed to marshal migrated message: %v", err)
 			} else {
-				err = os.WriteFile(GetDataPath()+name+".json", data, 0644)
+				err = WriteFileAtomic(GetDataPath()+name+".json", data, 0644)
 				if err != nil {
 					log.Errorf("Failed to create %s.json: %v", name, err)
 				}
@@ -15,6 +15,41 @@ type Server struct {
 	Shutdown bool          `json:"-"`
 	Worker   *Worker       `json:"-"`
 	bodyMu   sync.RWMutex
+
+	// ServiceBackoff spaces out service host polls while they are failing
+	ServiceBackoff Backoff `json:"-"`
+
+	// stop is closed when the server is shut down
+	stop   chan struct{}
+	stopMu sync.Mutex
+}
+
+// Done returns a channel that is closed when the server is shut down
+func (s *Server) Done() <-chan struct{} {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+		if s.Shutdown {
+			close(s.stop)
+		}
+	}
+	return s.stop
+}
+
+// Stop shuts the server down
+func (s *Server) Stop() {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	if !s.Shutdown {
+		s.Shutdown = true
+		close(s.stop)
+	}
 }
 
 func (s *Server) GetBody() []byte {
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NAT-PMP client, RFC 6886
+
+const (
+	natpmpVersion         = 0
+	natpmpOpExternal      = 0
+	natpmpOpMapUDP        = 1
+	natpmpResponse        = 128
+	natpmpUnsupportedVers = 1
+)
+
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// natpmpMapper maps ports with NAT-PMP
+type natpmpMapper struct {
+	address string
+
+	mu       sync.Mutex
+	mappings map[uint16]uint16 // the external port granted for each port
+}
+
+// NewNATPMPMapper returns a mapper for the NAT-PMP server at address, or
+// an error if it doesn't answer
+func NewNATPMPMapper(address string) (PortMapper, error) {
+	m := &natpmpMapper{address: address, mappings: make(map[uint16]uint16)}
+	if _, err := m.ExternalAddress(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *natpmpMapper) Name() string { return "NAT-PMP" }
+
+// request sends a request and returns the response after the result code
+func (m *natpmpMapper) request(request []byte, size int) ([]byte, error) {
+
+	op := request[1]
+	response, err := portMapExchange(m.address, request, func(b []byte) bool {
+		// a PCP server answers with its own version and an error
+		return len(b) >= 4 && b[1] == op|natpmpResponse
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if response[0] != natpmpVersion {
+		return nil, errPortMapUnsupported
+	}
+	result := binary.BigEndian.Uint16(response[2:4])
+	if result == natpmpUnsupportedVers {
+		return nil, errPortMapUnsupported
+	}
+	if result != 0 {
+		if text, found := natpmpResults[result]; found {
+			return nil, fmt.Errorf("NAT-PMP error: %s", text)
+		}
+		return nil, fmt.Errorf("NAT-PMP error %d", result)
+	}
+	if len(response) < size {
+		return nil, fmt.Errorf("short NAT-PMP response")
+	}
+
+	// skip the seconds since the gateway started
+	return response[8:size], nil
+}
+
+func (m *natpmpMapper) ExternalAddress() (net.IP, error) {
+
+	response, err := m.request([]byte{natpmpVersion, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(response[0], response[1], response[2], response[3]), nil
+}
+
+func (m *natpmpMapper) mapPort(port uint16, external uint16, lifetime time.Duration) (PortMapping, error) {
+
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(request[4:6], port)
+	binary.BigEndian.PutUint16(request[6:8], external)
+	binary.BigEndian.PutUint32(request[8:12], uint32(lifetime/time.Second))
+
+	response, err := m.request(request, 16)
+	if err != nil {
+		return PortMapping{}, err
+	}
+
+	return PortMapping{
+		InternalPort: binary.BigEndian.Uint16(response[0:2]),
+		ExternalPort: binary.BigEndian.Uint16(response[2:4]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[4:8])) * time.Second,
+	}, nil
+}
+
+// AddMapping asks for the external port the gateway gave the mapping
+// before, so a renewal keeps it (RFC 6886 section 3.3)
+func (m *natpmpMapper) AddMapping(port uint16, lifetime time.Duration, description string) (PortMapping, error) {
+
+	m.mu.Lock()
+	external, found := m.mappings[port]
+	if !found {
+		external = port
+	}
+	m.mu.Unlock()
+
+	mapping, err := m.mapPort(port, external, lifetime)
+	if err != nil {
+		return mapping, err
+	}
+
+	m.mu.Lock()
+	m.mappings[port] = mapping.ExternalPort
+	m.mu.Unlock()
+
+	return mapping, nil
+}
+
+func (m *natpmpMapper) DeleteMapping(port uint16) error {
+
+	_, err := m.mapPort(port, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.mappings, port)
+	m.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestNATPMPMapAndDelete(t *testing.T) {
+
+	g := newFakeGateway(t, false)
+
+	mapper, err := NewNATPMPMapper(cfg.PortMapGateway)
+	if err != nil {
+		t.Fatalf("NewNATPMPMapper: %v", err)
+	}
+
+	external, err := mapper.ExternalAddress()
+	if err != nil || !external.Equal(fakeExternal) {
+		t.Errorf("ExternalAddress: got %v, %v", external, err)
+	}
+
+	mapping, err := mapper.AddMapping(51820, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if mapping.InternalPort != 51820 || mapping.ExternalPort != 52820 {
+		t.Errorf("got ports %d -> %d, want 51820 -> 52820", mapping.InternalPort, mapping.ExternalPort)
+	}
+	if mapping.Lifetime != time.Hour {
+		t.Errorf("got lifetime %v, want %v", mapping.Lifetime, time.Hour)
+	}
+
+	// a renewal asks for the external port the gateway gave it
+	mapping, err = mapper.AddMapping(51820, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("renewing: %v", err)
+	}
+	requests := g.Requests()
+	renew := requests[len(requests)-1]
+	if port := binary.BigEndian.Uint16(renew[6:8]); port != 52820 {
+		t.Errorf("suggested external port %d, want 52820", port)
+	}
+	if mapping.ExternalPort != 52820 {
+		t.Errorf("renewal got external port %d, want 52820", mapping.ExternalPort)
+	}
+
+	if err := mapper.DeleteMapping(51820); err != nil {
+		t.Fatalf("DeleteMapping: %v", err)
+	}
+
+	// a delete asks for external port 0 with a lifetime of 0
+	requests = g.Requests()
+	remove := requests[len(requests)-1]
+	if remove[1] != natpmpOpMapUDP || binary.BigEndian.Uint16(remove[4:6]) != 51820 ||
+		binary.BigEndian.Uint16(remove[6:8]) != 0 || binary.BigEndian.Uint32(remove[8:12]) != 0 {
+		t.Errorf("unexpected delete request %v", remove)
+	}
+}
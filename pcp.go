@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// PCP client, RFC 6887
+
+const (
+	pcpVersion        = 2
+	pcpOpAnnounce     = 0
+	pcpOpMap          = 1
+	pcpResponse       = 0x80
+	pcpHeaderSize     = 24
+	pcpMapSize        = 36
+	pcpProtocolUDP    = 17
+	pcpUnsupportedVer = 1
+)
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external address",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+// pcpMapper maps ports with PCP
+type pcpMapper struct {
+	address string
+	client  net.IP // our address as the server sees it
+
+	mu       sync.Mutex
+	mappings map[uint16]*pcpMapping
+	external net.IP
+}
+
+// pcpMapping is what it takes to renew a mapping
+type pcpMapping struct {
+	nonce    [12]byte
+	external uint16
+	ip       net.IP
+}
+
+// NewPCPMapper returns a mapper for the PCP server at address, or an
+// error if it doesn't answer
+func NewPCPMapper(address string) (PortMapper, error) {
+
+	// the server checks the client address in the request against the
+	// packet's source
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	client := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	m := &pcpMapper{
+		address:  address,
+		client:   client,
+		mappings: make(map[uint16]*pcpMapping),
+	}
+	if _, err := m.request(pcpOpAnnounce, 0, nil); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *pcpMapper) Name() string { return "PCP" }
+
+// request sends a request and returns the response's lifetime and
+// opcode specific data
+func (m *pcpMapper) request(op byte, lifetime time.Duration, data []byte) ([]byte, error) {
+
+	request := make([]byte, pcpHeaderSize, pcpHeaderSize+len(data))
+	request[0] = pcpVersion
+	request[1] = op
+	binary.BigEndian.PutUint32(request[4:8], uint32(lifetime/time.Second))
+	copy(request[8:24], m.client.To16())
+	request = append(request, data...)
+
+	response, err := portMapExchange(m.address, request, func(b []byte) bool {
+		// a NAT-PMP server answers with its own version and an error
+		return len(b) >= 4 && b[1] == op|pcpResponse
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if response[0] != pcpVersion || response[3] == pcpUnsupportedVer {
+		return nil, errPortMapUnsupported
+	}
+	if result := response[3]; result != 0 {
+		if text, found := pcpResults[result]; found {
+			return nil, fmt.Errorf("PCP error: %s", text)
+		}
+		return nil, fmt.Errorf("PCP error %d", result)
+	}
+	if len(response) < pcpHeaderSize+len(data) {
+		return nil, fmt.Errorf("short PCP response")
+	}
+
+	// the lifetime, then the opcode's data
+	return append(append([]byte{}, response[4:8]...), response[pcpHeaderSize:]...), nil
+}
+
+func (m *pcpMapper) ExternalAddress() (net.IP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// PCP only reports it in a mapping
+	if m.external == nil {
+		return nil, fmt.Errorf("no PCP mapping yet")
+	}
+	return m.external, nil
+}
+
+// mapPort sends a MAP request, reusing the nonce and external port of a
+// mapping being renewed
+func (m *pcpMapper) mapPort(port uint16, lifetime time.Duration) (PortMapping, error) {
+
+	m.mu.Lock()
+	previous, found := m.mappings[port]
+	if !found {
+		previous = &pcpMapping{external: port}
+		rand.Read(previous.nonce[:])
+	}
+	m.mu.Unlock()
+
+	data := make([]byte, pcpMapSize)
+	copy(data[0:12], previous.nonce[:])
+	data[12] = pcpProtocolUDP
+	binary.BigEndian.PutUint16(data[16:18], port)
+	binary.BigEndian.PutUint16(data[18:20], previous.external)
+	if previous.ip != nil {
+		copy(data[20:36], previous.ip.To16())
+	} else {
+		// any IPv4 address
+		copy(data[20:36], net.IPv4zero.To16())
+	}
+
+	response, err := m.request(pcpOpMap, lifetime, data)
+	if err != nil {
+		return PortMapping{}, err
+	}
+	if string(response[4:16]) != string(previous.nonce[:]) {
+		return PortMapping{}, fmt.Errorf("PCP response for another mapping")
+	}
+
+	mapping := PortMapping{
+		InternalPort: binary.BigEndian.Uint16(response[20:22]),
+		ExternalPort: binary.BigEndian.Uint16(response[22:24]),
+		ExternalIP:   net.IP(append([]byte{}, response[24:40]...)),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[0:4])) * time.Second,
+	}
+	if ip4 := mapping.ExternalIP.To4(); ip4 != nil {
+		mapping.ExternalIP = ip4
+	}
+
+	m.mu.Lock()
+	if lifetime == 0 {
+		delete(m.mappings, port)
+	} else {
+		m.mappings[port] = &pcpMapping{nonce: previous.nonce, external: mapping.ExternalPort, ip: mapping.ExternalIP}
+		m.external = mapping.ExternalIP
+	}
+	m.mu.Unlock()
+
+	return mapping, nil
+}
+
+func (m *pcpMapper) AddMapping(port uint16, lifetime time.Duration, description string) (PortMapping, error) {
+	return m.mapPort(port, lifetime)
+}
+
+func (m *pcpMapper) DeleteMapping(port uint16) error {
+	_, err := m.mapPort(port, 0)
+	return err
+}
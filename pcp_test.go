@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPCPMap(t *testing.T) {
+
+	g := newFakeGateway(t, true)
+
+	mapper, err := NewPCPMapper(cfg.PortMapGateway)
+	if err != nil {
+		t.Fatalf("NewPCPMapper: %v", err)
+	}
+
+	// the mapper announces itself before anything else
+	requests := g.Requests()
+	if len(requests) != 1 || requests[0][1] != pcpOpAnnounce {
+		t.Fatalf("expected an ANNOUNCE, got %v", requests)
+	}
+
+	// PCP only learns the external address from a mapping
+	if _, err := mapper.ExternalAddress(); err == nil {
+		t.Errorf("ExternalAddress before a mapping should fail")
+	}
+
+	mapping, err := mapper.AddMapping(51820, time.Hour, "test")
+	if err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if mapping.InternalPort != 51820 || mapping.ExternalPort != 52820 {
+		t.Errorf("got ports %d -> %d, want 51820 -> 52820", mapping.InternalPort, mapping.ExternalPort)
+	}
+	if !mapping.ExternalIP.Equal(fakeExternal) {
+		t.Errorf("got external address %v, want %v", mapping.ExternalIP, fakeExternal)
+	}
+	if mapping.Lifetime != time.Hour {
+		t.Errorf("got lifetime %v, want %v", mapping.Lifetime, time.Hour)
+	}
+
+	external, err := mapper.ExternalAddress()
+	if err != nil || !external.Equal(fakeExternal) {
+		t.Errorf("ExternalAddress: got %v, %v", external, err)
+	}
+}
+
+func TestPCPRenewAndDelete(t *testing.T) {
+
+	g := newFakeGateway(t, true)
+
+	mapper, err := NewPCPMapper(cfg.PortMapGateway)
+	if err != nil {
+		t.Fatalf("NewPCPMapper: %v", err)
+	}
+
+	if _, err := mapper.AddMapping(51820, time.Hour, "test"); err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	if _, err := mapper.AddMapping(51820, time.Hour, "test"); err != nil {
+		t.Fatalf("renewing: %v", err)
+	}
+	if err := mapper.DeleteMapping(51820); err != nil {
+		t.Fatalf("DeleteMapping: %v", err)
+	}
+
+	requests := g.Requests()
+	if len(requests) != 4 {
+		t.Fatalf("got %d requests, want ANNOUNCE, 2 MAPs and a delete", len(requests))
+	}
+	first, renew, remove := requests[1], requests[2], requests[3]
+
+	// a renewal and a delete carry the nonce and the external port and
+	// address the gateway gave the mapping
+	nonce := first[pcpHeaderSize : pcpHeaderSize+12]
+	for _, request := range [][]byte{renew, remove} {
+		data := request[pcpHeaderSize:]
+		if !bytes.Equal(data[0:12], nonce) {
+			t.Errorf("nonce changed")
+		}
+		if port := binary.BigEndian.Uint16(data[18:20]); port != 52820 {
+			t.Errorf("suggested external port %d, want 52820", port)
+		}
+		if !bytes.Equal(data[20:36], fakeExternal.To16()) {
+			t.Errorf("suggested external address %v, want %v", data[20:36], fakeExternal)
+		}
+	}
+
+	if lifetime := binary.BigEndian.Uint32(renew[4:8]); lifetime != 3600 {
+		t.Errorf("renewal lifetime %d, want 3600", lifetime)
+	}
+	if lifetime := binary.BigEndian.Uint32(remove[4:8]); lifetime != 0 {
+		t.Errorf("delete lifetime %d, want 0", lifetime)
+	}
+
+	// once deleted, the next mapping starts over with a new nonce
+	if _, err := mapper.AddMapping(51820, time.Hour, "test"); err != nil {
+		t.Fatalf("AddMapping: %v", err)
+	}
+	requests = g.Requests()
+	if bytes.Equal(requests[4][pcpHeaderSize:pcpHeaderSize+12], nonce) {
+		t.Errorf("nonce reused after delete")
+	}
+}
+
+func TestPCPUnsupportedVersion(t *testing.T) {
+
+	newFakeGateway(t, false)
+
+	if _, err := NewPCPMapper(cfg.PortMapGateway); err != errPortMapUnsupported {
+		t.Errorf("got %v, want %v", err, errPortMapUnsupported)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Crash-safe state files.
+//
+// WriteFileAtomic writes a new file next to the old one, flushes it to
+// disk and renames it into place, so a crash leaves either the old or the
+// new contents, never a mix.  The file it replaces is kept as <name>.bak,
+// and ReadFileSafe falls back to it when the file can't be read or fails
+// to parse.
+
+const backupSuffix = ".bak"
+
+// WriteFileAtomic replaces a file with data, keeping the previous
+// contents as a backup
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+
+	// Keep the current file unless it is damaged JSON about to be replaced
+	// by good JSON, so the backup is the last good copy
+	return WriteFileAtomicBackup(path, data, perm, func(old []byte) bool {
+		return !json.Valid(data) || json.Valid(old)
+	})
+}
+
+// WriteFileAtomicBackup is WriteFileAtomic, but the current contents only
+// become the backup if keep approves them
+func WriteFileAtomicBackup(path string, data []byte, perm os.FileMode, keep func(old []byte) bool) error {
+
+	old, err := os.ReadFile(path)
+	if err == nil && len(old) > 0 && keep(old) {
+		if err := writeFileAtomic(path+backupSuffix, old, perm); err != nil {
+			log.Errorf("Error backing up %s: %v", path, err)
+		}
+	}
+
+	return writeFileAtomic(path, data, perm)
+}
+
+// writeFileAtomic writes a temporary file, syncs it and renames it over
+// path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+
+	dir := filepath.Dir(path)
+
+	file, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+
+	// the temporary file is only readable by us until it's complete
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// make the rename itself durable
+	if err := syncDir(dir); err != nil {
+		log.Debugf("Error syncing %s: %v", dir, err)
+	}
+
+	return nil
+}
+
+// ReadFileSafe reads a file written by WriteFileAtomic.  If it is missing,
+// empty or rejected by valid, the backup is used and put back in place.
+// Without a usable backup the original error is returned.
+func ReadFileSafe(path string, valid func([]byte) error) ([]byte, error) {
+
+	data, err := os.ReadFile(path)
+	if err == nil && len(data) == 0 {
+		err = errors.New("file is empty")
+	}
+	if err == nil && valid != nil {
+		err = valid(data)
+	}
+	if err == nil {
+		return data, nil
+	}
+
+	backup, berr := os.ReadFile(path + backupSuffix)
+	if berr != nil || len(backup) == 0 {
+		return data, err
+	}
+	if valid != nil && valid(backup) != nil {
+		return data, err
+	}
+
+	log.Errorf("Error reading %s: %v.  Recovered it from %s", path, err, path+backupSuffix)
+
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(path + backupSuffix); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if werr := writeFileAtomic(path, backup, perm); werr != nil {
+		log.Errorf("Error restoring %s: %v", path, werr)
+	}
+
+	return backup, nil
+}
+
+// ValidJSON rejects data that isn't JSON, for ReadFileSafe
+func ValidJSON(data []byte) error {
+	if !json.Valid(data) {
+		return errors.New("invalid JSON")
+	}
+	return nil
+}
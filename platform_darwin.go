@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/miekg/dns"
@@ -119,6 +121,26 @@ func StopWireguard(netName string) error {
 
 }
 
+// UpdateWireguardPeers applies a peer-only change to a running tunnel
+func UpdateWireguardPeers(netName string, diff *VPNDiff) error {
+
+	netName = Sanitize(netName)
+
+	// wg-quick only installs routes when the interface comes up
+	if diff.Routes {
+		return errLiveUnsupported
+	}
+
+	// find the utun interface from the network name
+	file, err := os.ReadFile("/var/run/wireguard/" + netName + ".name")
+	if err != nil {
+		return err
+	}
+	utun := strings.TrimSpace(string(file))
+
+	return ConfigureWireguardPeers(utun, netName)
+}
+
 func IsWireguardRunning(name string) (bool, error) {
 
 	name = Sanitize(name)
@@ -214,3 +236,23 @@ func FlushDNS() {
 		}
 	}()
 }
+
+// StartSocket is only supported on Linux
+func StartSocket(path string) {
+	log.Errorf("Unix socket %s is not supported on %s", path, Platform())
+}
+
+// EnableKillSwitch is only supported on Linux
+func EnableKillSwitch(netName string) error {
+	return fmt.Errorf("kill switch is not supported on %s", Platform())
+}
+
+// DisableKillSwitch is only supported on Linux
+func DisableKillSwitch(netName string) error {
+	return nil
+}
+
+// keyringSecret is only supported on Linux
+func keyringSecret(description string) ([]byte, error) {
+	return nil, fmt.Errorf("the kernel keyring is not supported on %s", Platform())
+}
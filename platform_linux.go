@@ -12,6 +12,7 @@ import (
 	"github.com/miekg/dns"
 	"github.com/nettica-com/nettica-admin/model"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 )
 
 func GetWireguardPath() string {
@@ -54,6 +55,17 @@ func StartWireguard(netName string) error {
 
 	netName = Sanitize(netName)
 
+	if nativeWireguard() {
+		err := StartWireguardNative(netName)
+		if err == nil {
+			FlushDNS()
+			startKillSwitch(netName)
+			return nil
+		}
+		// No kernel module, try wg-quick which can fall back to wireguard-go
+		log.Errorf("Error starting WireGuard natively: %s %v, trying wg-quick", netName, err)
+	}
+
 	args := []string{"wg-quick", "up", netName}
 
 	cmd := exec.Command("/bin/bash", args...)
@@ -66,23 +78,47 @@ func StartWireguard(netName string) error {
 	}
 
 	FlushDNS()
+	startKillSwitch(netName)
 
 	return err
 
 }
 
+// startKillSwitch installs the kill switch for a tunnel that has just started
+func startKillSwitch(netName string) {
+	if KillSwitchEnabled(netName) {
+		if err := EnableKillSwitch(netName); err != nil {
+			log.Errorf("Error installing kill switch for %s: %v", netName, err)
+		}
+	}
+}
+
 func StopWireguard(netName string) error {
 
 	netName = Sanitize(netName)
 
-	args := []string{"wg-quick", "down", netName}
+	// The tunnel is going down on purpose, don't block the network
+	if err := DisableKillSwitch(netName); err != nil {
+		log.Errorf("Error removing kill switch for %s: %v", netName, err)
+	}
 
-	cmd := exec.Command("/bin/bash", args...)
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	err := cmd.Run()
-	if err != nil {
-		log.Errorf("Error stopping WireGuard: %s %v (%s)", netName, err, out.String())
+	var err error
+	if nativeWireguard() {
+		// This also removes interfaces brought up by the wg-quick fallback
+		err = StopWireguardNative(netName)
+		if err != nil {
+			log.Errorf("Error stopping WireGuard: %s %v", netName, err)
+		}
+	} else {
+		args := []string{"wg-quick", "down", netName}
+
+		cmd := exec.Command("/bin/bash", args...)
+		var out bytes.Buffer
+		cmd.Stderr = &out
+		err = cmd.Run()
+		if err != nil {
+			log.Errorf("Error stopping WireGuard: %s %v (%s)", netName, err, out.String())
+		}
 	}
 
 	if err == nil {
@@ -99,10 +135,39 @@ func StopWireguard(netName string) error {
 
 }
 
+// UpdateWireguardPeers applies a peer-only change to a running tunnel
+func UpdateWireguardPeers(netName string, diff *VPNDiff) error {
+
+	netName = Sanitize(netName)
+
+	if nativeWireguard() {
+		link, err := netlink.LinkByName(netName)
+		if err != nil {
+			return err
+		}
+		conf, err := ReadWireguardConfig(netName)
+		if err != nil {
+			return err
+		}
+		return ApplyWireguardNative(link, conf)
+	}
+
+	// wg-quick only installs routes when the interface comes up
+	if diff.Routes {
+		return errLiveUnsupported
+	}
+
+	return ConfigureWireguardPeers(netName, netName)
+}
+
 func IsWireguardRunning(name string) (bool, error) {
 
 	name = Sanitize(name)
 
+	if nativeWireguard() {
+		return IsWireguardRunningNative(name), nil
+	}
+
 	cmd := exec.Command("wg", "show", name)
 	err := cmd.Run()
 	if err != nil {
@@ -207,6 +207,19 @@ func StopWireguard(netName string) error {
 
 }
 
+// UpdateWireguardPeers applies a peer-only change to a running tunnel
+func UpdateWireguardPeers(netName string, diff *VPNDiff) error {
+
+	netName = Sanitize(netName)
+
+	// The tunnel service only installs routes when it starts
+	if diff.Routes {
+		return errLiveUnsupported
+	}
+
+	return ConfigureWireguardPeers(netName, netName)
+}
+
 func IsWireguardRunning(netName string) (bool, error) {
 
 	netName = Sanitize(netName)
@@ -347,3 +360,28 @@ func FlushDNS() error {
 
 	return err
 }
+
+// StartSocket is only supported on Linux
+func StartSocket(path string) {
+	log.Errorf("Unix socket %s is not supported on %s", path, Platform())
+}
+
+// EnableKillSwitch is only supported on Linux
+func EnableKillSwitch(netName string) error {
+	return fmt.Errorf("kill switch is not supported on %s", Platform())
+}
+
+// DisableKillSwitch is only supported on Linux
+func DisableKillSwitch(netName string) error {
+	return nil
+}
+
+// keyringSecret is only supported on Linux
+func keyringSecret(description string) ([]byte, error) {
+	return nil, fmt.Errorf("the kernel keyring is not supported on %s", Platform())
+}
+
+// syncDir is not needed on Windows, where directories can't be synced
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackpal/gateway"
+	"github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Port mapping.
+//
+// A VPN with UPnP enabled asks the gateway to forward its WireGuard port
+// to this device, using whichever of PCP (RFC 6887), NAT-PMP (RFC 6886)
+// or UPnP IGD the gateway speaks.  cfg.PortMapper picks one instead.
+// Each VPN's mapping is renewed halfway through its lease, and the
+// external address and port the gateway reports become the VPN's
+// endpoint.
+
+const (
+	portMapPort     = 5351
+	portMapLifetime = 2 * time.Hour
+	portMapRefresh  = 30 * time.Minute // for mappings without a lifetime
+	portMapMinWait  = 30 * time.Second
+	portMapTries    = 4 // 3.75 seconds in all
+)
+
+// 100.64.0.0/10, used by carrier-grade NAT
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+var errPortMapUnsupported = errors.New("port mapping protocol not supported by the gateway")
+
+// PortMapper forwards a UDP port on the gateway to this device
+type PortMapper interface {
+	Name() string
+
+	// ExternalAddress returns the gateway's public address
+	ExternalAddress() (net.IP, error)
+
+	// AddMapping creates or renews the mapping for an internal port,
+	// asking for the same external port
+	AddMapping(port uint16, lifetime time.Duration, description string) (PortMapping, error)
+
+	// DeleteMapping removes the mapping for an internal port
+	DeleteMapping(port uint16) error
+}
+
+// PortMapping is a mapping granted by the gateway
+type PortMapping struct {
+	InternalPort uint16
+	ExternalPort uint16
+	ExternalIP   net.IP        // nil if the protocol doesn't report it
+	Lifetime     time.Duration // 0 if it doesn't expire
+}
+
+// portMapGateway returns the address of the gateway's PCP and NAT-PMP
+// server
+func portMapGateway() (string, error) {
+
+	if cfg.PortMapGateway != "" {
+		if _, _, err := net.SplitHostPort(cfg.PortMapGateway); err == nil {
+			return cfg.PortMapGateway, nil
+		}
+		return net.JoinHostPort(cfg.PortMapGateway, strconv.Itoa(portMapPort)), nil
+	}
+
+	ip, err := gateway.DiscoverGateway()
+	if err != nil {
+		return "", fmt.Errorf("error finding the default gateway: %v", err)
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(portMapPort)), nil
+}
+
+// DiscoverPortMapper returns a mapper for the protocol the gateway
+// supports, trying the quick ones first
+func DiscoverPortMapper() (PortMapper, error) {
+
+	protocols := []string{"pcp", "natpmp", "upnp"}
+	if cfg.PortMapper != "" && cfg.PortMapper != "auto" {
+		protocols = []string{cfg.PortMapper}
+	}
+
+	var address string
+	var err error
+	for _, protocol := range protocols {
+		var mapper PortMapper
+		switch protocol {
+		case "pcp", "natpmp":
+			if address == "" {
+				if address, err = portMapGateway(); err != nil {
+					log.Debugf("Port mapping: %v", err)
+					continue
+				}
+			}
+			if protocol == "pcp" {
+				mapper, err = NewPCPMapper(address)
+			} else {
+				mapper, err = NewNATPMPMapper(address)
+			}
+		case "upnp":
+			mapper, err = NewUPnPMapper()
+		default:
+			return nil, fmt.Errorf("unknown port mapping protocol %s", protocol)
+		}
+		if err != nil {
+			log.Debugf("Port mapping: %s: %v", protocol, err)
+			continue
+		}
+		log.Infof("Port mapping with %s", mapper.Name())
+		return mapper, nil
+	}
+
+	return nil, errors.New("the gateway doesn't support PCP, NAT-PMP or UPnP")
+}
+
+// portMapLease keeps a VPN's port mapped
+type portMapLease struct {
+	netName     string
+	port        uint16
+	description string
+	backoff     Backoff
+	stop        chan bool
+}
+
+var (
+	portMaps     = make(map[string]*portMapLease)
+	portMapsLock sync.Mutex
+)
+
+// ConfigurePortMapping maps a VPN's listen port on the gateway, or
+// removes the mapping if the VPN no longer wants it
+func ConfigurePortMapping(vpn model.VPN) {
+
+	netName := vpn.NetName
+	want := vpn.Current.UPnP && vpn.Current.ListenPort != 0 && vpn.Current.Endpoint != ""
+
+	portMapsLock.Lock()
+	defer portMapsLock.Unlock()
+
+	lease, found := portMaps[netName]
+	if found && want && lease.port == uint16(vpn.Current.ListenPort) {
+		// the lease renews itself
+		return
+	}
+	if found {
+		close(lease.stop)
+		delete(portMaps, netName)
+	}
+	if !want {
+		return
+	}
+
+	lease = &portMapLease{
+		netName:     netName,
+		port:        uint16(vpn.Current.ListenPort),
+		description: vpn.Name + "-" + vpn.NetName,
+		backoff:     Backoff{Name: "port mapping for " + netName},
+		stop:        make(chan bool),
+	}
+	portMaps[netName] = lease
+	go lease.run()
+}
+
+// StopPortMapping removes a net's mapping, eg. when it is deleted
+func StopPortMapping(netName string) {
+
+	portMapsLock.Lock()
+	defer portMapsLock.Unlock()
+
+	if lease, found := portMaps[netName]; found {
+		close(lease.stop)
+		delete(portMaps, netName)
+	}
+}
+
+// run maps the port and renews the mapping until the lease is stopped
+func (l *portMapLease) run() {
+
+	var mapper PortMapper
+	wait := time.Duration(0)
+
+	for {
+		select {
+		case <-l.stop:
+			if mapper != nil {
+				if err := mapper.DeleteMapping(l.port); err != nil {
+					log.Errorf("Error deleting %s port mapping for %s: %v", mapper.Name(), l.netName, err)
+				}
+			}
+			return
+		case <-time.After(wait):
+		}
+
+		var err error
+		if mapper == nil {
+			mapper, err = DiscoverPortMapper()
+			if err != nil {
+				wait = l.backoff.Failure(err, 0)
+				continue
+			}
+		}
+
+		mapping, err := mapper.AddMapping(l.port, portMapLifetime, l.description)
+		if err != nil {
+			log.Errorf("Error adding %s port mapping for %s: %v", mapper.Name(), l.netName, err)
+			// the gateway may have changed, start over
+			mapper = nil
+			wait = l.backoff.Failure(err, 0)
+			continue
+		}
+		l.backoff.Success()
+
+		log.Infof("Port mapping: %s maps %d to %d for %v", mapper.Name(), mapping.InternalPort, mapping.ExternalPort, mapping.Lifetime)
+
+		external := mapping.ExternalIP
+		if external == nil {
+			external, err = mapper.ExternalAddress()
+		}
+		if err != nil {
+			log.Errorf("Error getting external address from %s: %v", mapper.Name(), err)
+		} else {
+			UpdateEndpoint(l.netName, external, mapping.ExternalPort)
+		}
+
+		wait = mapping.Lifetime / 2
+		if wait == 0 {
+			wait = portMapRefresh
+		}
+		if wait < portMapMinWait {
+			wait = portMapMinWait
+		}
+	}
+}
+
+// UpdateEndpoint sets a VPN's endpoint to the address the gateway
+// reports, if it has changed
+func UpdateEndpoint(netName string, external net.IP, port uint16) {
+
+	externalIP := external.String()
+	if isBogon(externalIP) {
+		return
+	}
+	// behind another NAT the gateway's address isn't reachable
+	if external.IsPrivate() || sharedAddressSpace.Contains(external) {
+		log.Infof("Port mapping: external address %s is not public, leaving the endpoint alone", externalIP)
+		return
+	}
+
+	ServersMutex.Lock()
+	servers := make([]*Server, 0, len(Servers))
+	for _, s := range Servers {
+		servers = append(servers, s)
+	}
+	ServersMutex.Unlock()
+
+	for _, s := range servers {
+		if s.Worker == nil {
+			continue
+		}
+		v, _, _ := s.Worker.FindVPN(netName)
+		if v == nil {
+			continue
+		}
+		vpn := *v
+
+		host, oldPort, err := net.SplitHostPort(vpn.Current.Endpoint)
+		if err != nil {
+			log.Errorf("Invalid endpoint %s: %v", vpn.Current.Endpoint, err)
+			return
+		}
+		if port == 0 {
+			port64, _ := strconv.ParseUint(oldPort, 10, 16)
+			port = uint16(port64)
+		}
+		endpoint := net.JoinHostPort(externalIP, strconv.Itoa(int(port)))
+		if host == externalIP && oldPort == strconv.Itoa(int(port)) {
+			return
+		}
+
+		log.Infof("External address %s does not match endpoint %s", endpoint, vpn.Current.Endpoint)
+		vpn.Current.Endpoint = endpoint
+
+		// Update the vpn endpoint at nettica
+		if !vpn.Current.SyncEndpoint {
+			if err := s.Worker.UpdateVPN(&vpn); err != nil {
+				log.Errorf("Error updating vpn: %v", err)
+			}
+		}
+		return
+	}
+}
+
+// portMapExchange sends a request to a PCP or NAT-PMP server until accept
+// takes a response, doubling the timeout on each try as the RFCs say
+func portMapExchange(address string, request []byte, accept func([]byte) bool) ([]byte, error) {
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1100)
+	timeout := 250 * time.Millisecond
+	for try := 0; try < portMapTries; try++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				// eg. ICMP port unreachable, nothing is listening
+				return nil, errPortMapUnsupported
+			}
+			if accept(buf[:n]) {
+				return append([]byte{}, buf[:n]...), nil
+			}
+		}
+		timeout *= 2
+	}
+
+	return nil, fmt.Errorf("no response from %s", address)
+}
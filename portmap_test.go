@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway is a PCP and NAT-PMP server on 127.0.0.1.  Without PCP it
+// answers PCP requests the way a NAT-PMP only gateway does.
+type fakeGateway struct {
+	conn     *net.UDPConn
+	pcp      bool
+	external net.IP
+
+	mu       sync.Mutex
+	requests [][]byte
+	received chan []byte
+}
+
+// fakeExternal is the gateway's public address, from TEST-NET-3
+var fakeExternal = net.IPv4(203, 0, 113, 7).To4()
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	g := &fakeGateway{
+		conn:     conn,
+		pcp:      pcp,
+		external: fakeExternal,
+		received: make(chan []byte, 100),
+	}
+	go g.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	// point the mappers at the fake
+	saved := cfg.PortMapGateway
+	cfg.PortMapGateway = conn.LocalAddr().String()
+	t.Cleanup(func() { cfg.PortMapGateway = saved })
+
+	return g
+}
+
+func (g *fakeGateway) serve() {
+
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request := append([]byte{}, buf[:n]...)
+
+		g.mu.Lock()
+		g.requests = append(g.requests, request)
+		g.mu.Unlock()
+		g.received <- request
+
+		var response []byte
+		switch {
+		case request[0] == pcpVersion && g.pcp:
+			response = g.pcpResponse(request)
+		case request[0] == pcpVersion:
+			response = []byte{natpmpVersion, request[1] | natpmpResponse, 0, natpmpUnsupportedVers, 0, 0, 0, 0}
+		case request[0] == natpmpVersion:
+			response = g.natpmpResponse(request)
+		}
+		if response != nil {
+			g.conn.WriteToUDP(response, addr)
+		}
+	}
+}
+
+// pcpResponse answers ANNOUNCE and MAP, giving every mapping the internal
+// port plus 1000 unless it asks for another
+func (g *fakeGateway) pcpResponse(request []byte) []byte {
+
+	response := make([]byte, pcpHeaderSize)
+	response[0] = pcpVersion
+	response[1] = request[1] | pcpResponse
+	copy(response[4:8], request[4:8])
+
+	if request[1] == pcpOpMap {
+		data := append([]byte{}, request[pcpHeaderSize:pcpHeaderSize+pcpMapSize]...)
+		internal := binary.BigEndian.Uint16(data[16:18])
+		external := binary.BigEndian.Uint16(data[18:20])
+		if external == 0 || external == internal {
+			external = internal + 1000
+		}
+		binary.BigEndian.PutUint16(data[18:20], external)
+		copy(data[20:36], g.external.To16())
+		response = append(response, data...)
+	}
+
+	return response
+}
+
+// natpmpResponse answers the external address and UDP mapping requests,
+// giving every mapping the internal port plus 1000 unless it asks for
+// another
+func (g *fakeGateway) natpmpResponse(request []byte) []byte {
+
+	switch request[1] {
+	case natpmpOpExternal:
+		response := make([]byte, 12)
+		response[1] = natpmpOpExternal | natpmpResponse
+		copy(response[8:12], g.external)
+		return response
+
+	case natpmpOpMapUDP:
+		response := make([]byte, 16)
+		response[1] = natpmpOpMapUDP | natpmpResponse
+		copy(response[8:10], request[4:6])
+		internal := binary.BigEndian.Uint16(request[4:6])
+		external := binary.BigEndian.Uint16(request[6:8])
+		if external == internal {
+			external = internal + 1000
+		}
+		binary.BigEndian.PutUint16(response[10:12], external)
+		copy(response[12:16], request[8:12])
+		return response
+	}
+
+	return nil
+}
+
+// Requests returns the requests received so far
+func (g *fakeGateway) Requests() [][]byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([][]byte{}, g.requests...)
+}
+
+func TestDiscoverPortMapperPCP(t *testing.T) {
+
+	newFakeGateway(t, true)
+
+	mapper, err := DiscoverPortMapper()
+	if err != nil {
+		t.Fatalf("DiscoverPortMapper: %v", err)
+	}
+	if mapper.Name() != "PCP" {
+		t.Errorf("got %s, want PCP", mapper.Name())
+	}
+}
+
+func TestDiscoverPortMapperFallsBackToNATPMP(t *testing.T) {
+
+	g := newFakeGateway(t, false)
+
+	mapper, err := DiscoverPortMapper()
+	if err != nil {
+		t.Fatalf("DiscoverPortMapper: %v", err)
+	}
+	if mapper.Name() != "NAT-PMP" {
+		t.Fatalf("got %s, want NAT-PMP", mapper.Name())
+	}
+
+	// a PCP ANNOUNCE first, then NAT-PMP
+	requests := g.Requests()
+	if len(requests) < 2 || requests[0][0] != pcpVersion || requests[0][1] != pcpOpAnnounce || requests[len(requests)-1][0] != natpmpVersion {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
+
+func TestPortMapLeaseDeletesOnStop(t *testing.T) {
+
+	g := newFakeGateway(t, true)
+
+	lease := &portMapLease{
+		netName:     "portmap-test",
+		port:        51820,
+		description: "test",
+		backoff:     Backoff{Name: "port mapping test"},
+		stop:        make(chan bool),
+	}
+	done := make(chan bool)
+	go func() {
+		lease.run()
+		close(done)
+	}()
+
+	isMap := func(request []byte) bool { return request[1] == pcpOpMap }
+	timeout := time.After(10 * time.Second)
+	for mapped := false; !mapped; {
+		select {
+		case request := <-g.received:
+			mapped = isMap(request) && binary.BigEndian.Uint32(request[4:8]) != 0
+		case <-timeout:
+			close(lease.stop)
+			t.Fatalf("no MAP request")
+		}
+	}
+
+	close(lease.stop)
+	select {
+	case <-done:
+	case <-timeout:
+		t.Fatalf("the lease didn't stop")
+	}
+
+	requests := g.Requests()
+	remove := requests[len(requests)-1]
+	if !isMap(remove) || binary.BigEndian.Uint32(remove[4:8]) != 0 {
+		t.Errorf("the mapping wasn't deleted, last request %v", remove)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Push delivery of configuration changes.
+//
+// Each Worker keeps a WebSocket open to its server.  Every text frame the
+// server sends is a complete model.Message, the same body the status API
+// returns, and is handed straight to UpdateNetticaConfig.  While the stream
+// is connected the etag poll in StartServer slows down to pushPollInterval;
+// as soon as the stream drops the poll falls back to Device.CheckInterval
+// until the stream can be re-established.
+
+const (
+	pushPollInterval   = 300 // seconds between safety polls while the stream is up
+	pushPingInterval   = 30 * time.Second
+	pushReadTimeout    = 90 * time.Second
+	pushUnsupportedTry = 60 * time.Minute
+)
+
+var errPushUnsupported = errors.New("server does not support push")
+
+// StartPushService maintains the push subscription for the life of the server
+func (w *Worker) StartPushService() {
+
+	if !cfg.Push {
+		log.Info("Push: disabled, using polling only")
+		return
+	}
+
+	backoff := Backoff{Name: "push stream to " + w.Context.Name}
+
+	for !w.Context.Shutdown {
+		err := w.Subscribe()
+		connected := w.pushConnected.Swap(false)
+
+		if w.Context.Shutdown {
+			break
+		}
+
+		var wait time.Duration
+		if errors.Is(err, errPushUnsupported) {
+			// Older servers don't have the endpoint, don't keep asking
+			log.Infof("Push: %s does not support push, polling every %d seconds", w.Context.Name, w.Context.Config.Device.CheckInterval)
+			wait = pushUnsupportedTry
+		} else {
+			if err != nil {
+				log.Errorf("Push: stream to %s dropped: %v, falling back to polling", w.Context.Name, err)
+			}
+			// A stream that was up starts the backoff over
+			if connected {
+				backoff.Success()
+			}
+			wait = backoff.Failure(err, 0)
+		}
+
+		select {
+		case <-w.Context.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Subscribe opens the push stream and applies messages until it closes
+func (w *Worker) Subscribe() error {
+
+	device := w.Context.Config.Device
+	if device == nil || device.Server == "" || device.ApiKey == "" || device.Id == "" {
+		return fmt.Errorf("no device configuration")
+	}
+
+	reqURL := fmt.Sprintf(netticaDevicePushAPIFmt, device.Server, device.Id)
+	if strings.HasPrefix(reqURL, "https://") {
+		reqURL = "wss://" + strings.TrimPrefix(reqURL, "https://")
+	} else if strings.HasPrefix(reqURL, "http://") {
+		reqURL = "ws://" + strings.TrimPrefix(reqURL, "http://")
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		NetDial: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 70 * time.Second,
+			LocalAddr: cfg.sourceAddr,
+		}).Dial,
+	}
+
+	header := http.Header{}
+	header.Set("X-API-KEY", device.ApiKey)
+	header.Set("User-Agent", "nettica-client/"+Version)
+
+	log.Infof("  GET %s", reqURL)
+
+	conn, resp, err := dialer.Dial(reqURL, header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNotImplemented) {
+			return errPushUnsupported
+		}
+		return err
+	}
+	defer conn.Close()
+
+	log.Infof("Push: connected to %s", w.Context.Name)
+	w.pushConnected.Store(true)
+
+	conn.SetReadDeadline(time.Now().Add(pushReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pushReadTimeout))
+		return nil
+	})
+
+	// Keep the connection alive through NATs and proxies
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pushPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-w.Context.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+				if err != nil {
+					log.Debugf("Push: ping failed: %v", err)
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for !w.Context.Shutdown {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(pushReadTimeout))
+
+		if kind != websocket.TextMessage || len(data) == 0 {
+			continue
+		}
+
+		log.Infof("Push: received config from %s (%d bytes)", w.Context.Name, len(data))
+		w.UpdateNetticaConfig(data, false)
+	}
+
+	return nil
+}
+
+// PushConnected returns true when the push stream is delivering updates
+func (w *Worker) PushConnected() bool {
+	return w.pushConnected.Load()
+}
+
+// PollInterval is the number of seconds to wait between etag polls
+func (w *Worker) PollInterval() int64 {
+
+	interval := int64(10)
+	if w.Context.Config.Device != nil && w.Context.Config.Device.CheckInterval > 0 {
+		interval = w.Context.Config.Device.CheckInterval
+	}
+
+	if w.PushConnected() && interval < pushPollInterval {
+		interval = pushPollInterval
+	}
+
+	return interval
+}
+
+// Poll drives StartServer, ticking every PollInterval seconds until shutdown
+func (w *Worker) Poll() {
+
+	curTs := calculateCurrentTimestamp()
+
+	t := time.Unix(curTs, 0)
+	log.Debugf("current timestamp = %v (%s)", curTs, t.UTC())
+
+	last := int64(0)
+	for !w.Context.Shutdown {
+		time.Sleep(1000 * time.Millisecond)
+
+		// The interval is re-evaluated every second so a dropped push
+		// stream brings the poll back to CheckInterval immediately
+		if calculateCurrentTimestamp() >= last+w.PollInterval() {
+			w.Context.Running <- true
+			last = calculateCurrentTimestamp()
+		}
+	}
+
+	w.Context.Running <- false
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNS query log.
+//
+// The most recent queries are kept in a ring buffer for the local API.  If
+// cfg.DNSLogFile is set every query is also appended to it as a line of
+// JSON, and the file is rotated when it reaches cfg.DNSLogMaxSize.
+
+const dnsLogBackups = 3
+
+// QueryLogEntry describes one query answered by the DNS server
+type QueryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Server  string    `json:"server"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Source  string    `json:"source"`
+	Rcode   string    `json:"rcode"`
+	Latency float64   `json:"latency"` // milliseconds
+}
+
+// QueryLogFilter selects entries from the query log.  Empty fields match
+// every entry.
+type QueryLogFilter struct {
+	Name   string
+	Client string
+	Type   string
+	Source string
+	Rcode  string
+	Since  time.Time
+	Limit  int
+}
+
+// QueryLog is a fixed size ring buffer of queries
+type QueryLog struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+	sink    chan QueryLogEntry
+}
+
+var queryLog = &QueryLog{}
+
+// LogQuery records a query answered by handleQueries
+func LogQuery(r *dnsRecorder, q dns.Question, start time.Time) {
+
+	rcode := "NONE"
+	if r.rcode >= 0 {
+		rcode = dns.RcodeToString[r.rcode]
+	}
+
+	entry := QueryLogEntry{
+		Time:    start,
+		Client:  r.RemoteAddr().String(),
+		Server:  r.LocalAddr().String(),
+		Name:    strings.ToLower(strings.Trim(q.Name, ".")),
+		Type:    dns.TypeToString[q.Qtype],
+		Source:  r.source,
+		Rcode:   rcode,
+		Latency: float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	log.Debugf("DNS Query: %s %s %s %s %s %.3f ms", entry.Client, entry.Name, entry.Type, entry.Rcode, entry.Source, entry.Latency)
+
+	queryLog.Add(entry)
+}
+
+// Add appends an entry, overwriting the oldest if the log is full
+func (l *QueryLog) Add(entry QueryLogEntry) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg.DNSLogSize > 0 {
+		if len(l.entries) != cfg.DNSLogSize {
+			l.entries = make([]QueryLogEntry, cfg.DNSLogSize)
+			l.next = 0
+			l.full = false
+		}
+		l.entries[l.next] = entry
+		l.next = (l.next + 1) % len(l.entries)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+
+	if cfg.DNSLogFile != "" {
+		if l.sink == nil {
+			l.sink = make(chan QueryLogEntry, 1024)
+			go writeQueryLog(cfg.DNSLogFile, l.sink)
+		}
+		// never hold up a query for the file, drop the entry instead
+		select {
+		case l.sink <- entry:
+		default:
+		}
+	}
+}
+
+// Entries returns the entries matching a filter, newest first
+func (l *QueryLog) Entries(filter QueryLogFilter) []QueryLogEntry {
+
+	filter.Name = strings.ToLower(strings.Trim(filter.Name, "."))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+
+	entries := []QueryLogEntry{}
+	for i := 0; i < count; i++ {
+		entry := l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			break
+		}
+		if filter.Name != "" && !strings.Contains(entry.Name, filter.Name) {
+			continue
+		}
+		if filter.Client != "" && !strings.HasPrefix(entry.Client, filter.Client) {
+			continue
+		}
+		if filter.Type != "" && !strings.EqualFold(entry.Type, filter.Type) {
+			continue
+		}
+		if filter.Source != "" && !strings.EqualFold(entry.Source, filter.Source) {
+			continue
+		}
+		if filter.Rcode != "" && !strings.EqualFold(entry.Rcode, filter.Rcode) {
+			continue
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+	}
+
+	return entries
+}
+
+// Clear empties the log
+func (l *QueryLog) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = nil
+	l.next = 0
+	l.full = false
+}
+
+// writeQueryLog appends entries to the log file, rotating it when it
+// grows past cfg.DNSLogMaxSize
+func writeQueryLog(path string, entries chan QueryLogEntry) {
+
+	var file *os.File
+	var size int64
+
+	for entry := range entries {
+
+		if file == nil {
+			var err error
+			file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+			if err != nil {
+				log.Errorf("Error opening DNS query log %s: %v", path, err)
+				// try again with the next entry
+				continue
+			}
+			if info, err := file.Stat(); err == nil {
+				size = info.Size()
+			}
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+
+		n, err := file.Write(line)
+		size += int64(n)
+		if err != nil {
+			log.Errorf("Error writing DNS query log %s: %v", path, err)
+		}
+
+		if cfg.DNSLogMaxSize > 0 && size >= cfg.DNSLogMaxSize {
+			file.Close()
+			file = nil
+			rotateQueryLog(path)
+		}
+	}
+}
+
+// rotateQueryLog renames path to path.1, path.1 to path.2 and so on,
+// discarding the oldest
+func rotateQueryLog(path string) {
+
+	os.Remove(fmt.Sprintf("%s.%d", path, dnsLogBackups))
+	for i := dnsLogBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		log.Errorf("Error rotating DNS query log %s: %v", path, err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reconciling a net against a new configuration.
+//
+// Rather than bouncing the tunnel whenever the rendered configuration file
+// changes, UpdateNetticaConfig diffs the old and new VPNs.  Changes to the
+// peers (and to our own key) are applied to the running device, only
+// interface-level changes such as the address, listen port or MTU require
+// the tunnel to be restarted.
+
+// errLiveUnsupported is returned by UpdateWireguardPeers when a platform
+// can't apply a particular change without a restart
+var errLiveUnsupported = errors.New("live update not supported")
+
+// VPNDiff describes how a net changed between two configurations
+type VPNDiff struct {
+	Added     []string // peers that are new
+	Removed   []string // peers that are gone
+	Changed   []string // peers whose settings changed
+	Interface []string // interface settings that changed
+	Key       bool     // our key pair changed
+	Routes    bool     // the set of AllowedIPs changed
+}
+
+// Empty returns true if nothing changed
+func (d *VPNDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Interface) == 0 && !d.Key
+}
+
+// PeersOnly returns true if the change can be applied to a running tunnel
+func (d *VPNDiff) PeersOnly() bool {
+	return !d.Empty() && len(d.Interface) == 0
+}
+
+func (d *VPNDiff) String() string {
+	parts := []string{}
+	if len(d.Added) > 0 {
+		parts = append(parts, fmt.Sprintf("added %v", d.Added))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, fmt.Sprintf("removed %v", d.Removed))
+	}
+	if len(d.Changed) > 0 {
+		parts = append(parts, fmt.Sprintf("changed %v", d.Changed))
+	}
+	if len(d.Interface) > 0 {
+		parts = append(parts, fmt.Sprintf("interface %v", d.Interface))
+	}
+	if d.Key {
+		parts = append(parts, "key")
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DiffVPNs compares our VPN and its peers between two configurations
+func DiffVPNs(oldVPN *model.VPN, oldPeers []model.VPN, newVPN *model.VPN, newPeers []model.VPN) VPNDiff {
+
+	var d VPNDiff
+
+	o := oldVPN.Current
+	n := newVPN.Current
+
+	if !slices.Equal(o.Address, n.Address) {
+		d.Interface = append(d.Interface, "Address")
+	}
+	if o.ListenPort != n.ListenPort {
+		d.Interface = append(d.Interface, "ListenPort")
+	}
+	if o.Mtu != n.Mtu {
+		d.Interface = append(d.Interface, "MTU")
+	}
+	if !slices.Equal(o.Dns, n.Dns) {
+		d.Interface = append(d.Interface, "DNS")
+	}
+	if o.Table != n.Table {
+		d.Interface = append(d.Interface, "Table")
+	}
+	if o.PreUp != n.PreUp || o.PostUp != n.PostUp || o.PreDown != n.PreDown || o.PostDown != n.PostDown {
+		d.Interface = append(d.Interface, "Scripts")
+	}
+	if oldVPN.Enable != newVPN.Enable {
+		d.Interface = append(d.Interface, "Enable")
+	}
+	if oldVPN.Type != newVPN.Type {
+		d.Interface = append(d.Interface, "Type")
+	}
+	// The endpoint decides which peers the template includes
+	if (o.Endpoint == "") != (n.Endpoint == "") {
+		d.Interface = append(d.Interface, "Endpoint")
+	}
+
+	if o.PublicKey != n.PublicKey {
+		d.Key = true
+	}
+
+	old := make(map[string]*model.VPN)
+	for i := range oldPeers {
+		old[oldPeers[i].Id] = &oldPeers[i]
+	}
+
+	for i := range newPeers {
+		p := &newPeers[i]
+		q, found := old[p.Id]
+		if !found {
+			d.Added = append(d.Added, p.Name)
+			d.Routes = true
+			continue
+		}
+		delete(old, p.Id)
+
+		if !slices.Equal(q.Current.AllowedIPs, p.Current.AllowedIPs) {
+			d.Routes = true
+			d.Changed = append(d.Changed, p.Name)
+		} else if q.Current.PublicKey != p.Current.PublicKey ||
+			q.Current.PresharedKey != p.Current.PresharedKey ||
+			q.Current.Endpoint != p.Current.Endpoint ||
+			q.Current.PersistentKeepalive != p.Current.PersistentKeepalive ||
+			q.Enable != p.Enable {
+			d.Changed = append(d.Changed, p.Name)
+		}
+	}
+
+	for _, q := range old {
+		d.Removed = append(d.Removed, q.Name)
+		d.Routes = true
+	}
+
+	return d
+}
+
+// FindDeviceVPN returns our VPN in a net and a copy of the other VPNs
+func FindDeviceVPN(msg *model.Message, netName string, deviceID string) (*model.VPN, []model.VPN) {
+
+	for i := 0; i < len(msg.Config); i++ {
+		if msg.Config[i].NetName != netName {
+			continue
+		}
+		var vpn *model.VPN
+		peers := []model.VPN{}
+		for j := 0; j < len(msg.Config[i].VPNs); j++ {
+			if msg.Config[i].VPNs[j].DeviceID == deviceID {
+				v := msg.Config[i].VPNs[j]
+				vpn = &v
+			} else {
+				peers = append(peers, msg.Config[i].VPNs[j])
+			}
+		}
+		return vpn, peers
+	}
+
+	return nil, nil
+}
+
+// ApplyLive writes the new configuration and applies it to the running
+// tunnel if only the peers changed.  It returns false if the tunnel needs
+// to be restarted instead.  The new peers have had the local subnets
+// removed from their AllowedIPs, and so do the old ones before comparing.
+func (w *Worker) ApplyLive(oldconf *model.Message, vpn *model.VPN, vpns []model.VPN, subnets []*net.IPNet, text []byte) bool {
+
+	name := vpn.NetName
+
+	oldVPN, oldPeers := FindDeviceVPN(oldconf, name, w.Context.Config.Device.Id)
+	if oldVPN == nil || !oldVPN.Enable || !vpn.Enable {
+		return false
+	}
+	RemoveLocalAllowedIPs(oldPeers, subnets)
+
+	diff := DiffVPNs(oldVPN, oldPeers, vpn, vpns)
+	log.Infof("Changes to %s: %s", name, diff.String())
+
+	if !diff.PeersOnly() {
+		return false
+	}
+
+	running, _ := IsWireguardRunning(name)
+	if !running {
+		return false
+	}
+
+	err := writeFileAtomic(GetWireguardPath()+name+".conf", text, 0600)
+	if err != nil {
+		log.Errorf("Error writing file %s : %s", GetWireguardPath()+name+".conf", err)
+		return false
+	}
+
+	err = UpdateWireguardPeers(name, &diff)
+	if err != nil {
+		if !errors.Is(err, errLiveUnsupported) {
+			log.Errorf("Error updating %s in place, restarting: %v", name, err)
+		}
+		return false
+	}
+
+	log.Infof("Updated %s without a restart", name)
+	return true
+}
+
+// ConfigureWireguardPeers applies the key and peers from a net's
+// configuration file to a running device using wgctrl
+func ConfigureWireguardPeers(device string, netName string) error {
+
+	conf, err := ReadWireguardConfig(netName)
+	if err != nil {
+		return err
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	dev, err := client.Device(device)
+	if err != nil {
+		return err
+	}
+
+	key, err := wgtypes.ParseKey(conf.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+
+	peers, err := conf.PeerConfigs(dev.Peers)
+	if err != nil {
+		return err
+	}
+
+	return client.ConfigureDevice(device, wgtypes.Config{PrivateKey: &key, Peers: peers})
+}
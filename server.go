@@ -69,7 +69,7 @@ func LoadServers() error {
 
 			path := filepath.Join(dir, file.Name())
 
-			data, err := os.ReadFile(path)
+			data, err := ReadFileSafe(path, ValidJSON)
 			if err != nil {
 				log.Printf("Failed to read file %s: %v", path, err)
 				continue
@@ -122,7 +122,7 @@ func SaveServer(server *Server) {
 		log.Printf("Failed to marshal JSON: %v", err)
 		return
 	}
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	if err := WriteFileAtomic(path, data, 0644); err != nil {
 		log.Printf("Failed to write file %s: %v", path, err)
 	}
 	server.SetBody(data)
@@ -161,7 +161,7 @@ func RemoveServer(server *Server) {
 
 	delete(Servers, server.Path)
 
-	server.Shutdown = true
+	server.Stop()
 
 	log.Info("Server removed")
 
@@ -25,6 +25,7 @@ func StartServiceHost(s *Server, c chan bool) {
 	}
 
 	host = s.Config.Device.Server
+	s.ServiceBackoff.Name = s.Name + " service host"
 	var client *http.Client
 	var etag string
 
@@ -63,6 +64,10 @@ func StartServiceHost(s *Server, c chan bool) {
 			}
 		}
 
+		if s.ServiceBackoff.Remaining() > 0 {
+			continue
+		}
+
 		// Only make API call if ServiceGroup is set
 		if s.Config.Device.ServiceGroup != "" && s.Config.Device.ServiceApiKey != "" {
 			var reqURL string = fmt.Sprintf(netticaServiceHostAPIFmt, host, s.Config.Device.ServiceGroup)
@@ -81,11 +86,11 @@ func StartServiceHost(s *Server, c chan bool) {
 			}
 			resp, err := client.Do(req)
 			if err == nil {
+				s.ServiceBackoff.Response(resp)
 
 				if resp.StatusCode == 304 {
 				} else if resp.StatusCode != 200 {
-					log.Errorf("Response Error Code: %v, sleeping 10 seconds", resp.StatusCode)
-					time.Sleep(10 * time.Second)
+					log.Errorf("Response Error Code: %v", resp.StatusCode)
 				} else {
 					body, err := io.ReadAll(resp.Body)
 					if err != nil {
@@ -96,8 +101,8 @@ func StartServiceHost(s *Server, c chan bool) {
 					UpdateServiceHostConfig(s, body)
 				}
 			} else {
-				log.Errorf("ERROR: %v, sleeping 10 seconds", err)
-				time.Sleep(10 * time.Second)
+				log.Errorf("ERROR: %v", err)
+				s.ServiceBackoff.Failure(err, 0)
 			}
 			if resp != nil {
 				resp.Body.Close()
@@ -116,16 +121,9 @@ func StartContainers(s *Server) error {
 	path = strings.TrimSuffix(path, ".json")
 	path = path + "-service-host.json"
 
-	file, err := os.Open(path)
-
-	if err != nil {
-		log.Debugf("Error opening config file %v", err)
-		return err
-	}
-	body, err := io.ReadAll(file)
-	file.Close()
+	body, err := ReadFileSafe(path, ValidJSON)
 	if err != nil {
-		log.Errorf("Error reading service host config file: %v", err)
+		log.Debugf("Error reading service host config file: %v", err)
 		return err
 	}
 	var msg model.ServiceMessage
@@ -234,38 +232,17 @@ func UpdateNetticaServiceHost(s *Server, service model.Service) error {
 // UpdateServiceHostConfig updates the config from the server
 func UpdateServiceHostConfig(s *Server, body []byte) {
 
-	// If the file doesn't exist create it for the first time
-	if _, err := os.Stat(GetDataPath() + "my.nettica.com-service-host.json"); os.IsNotExist(err) {
-		file, err := os.OpenFile(GetDataPath()+"my.nettica.com-service-host.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-		if err == nil {
-			file.Close()
-		}
-	}
-
-	file, err := os.Open(GetDataPath() + "my.nettica.com-service-host.json")
-
-	if err != nil {
-		log.Errorf("Error opening service host config file %v", err)
-		return
-	}
-	conf, err := io.ReadAll(file)
-	file.Close()
-	if err != nil {
-		log.Errorf("Error reading nettica config file: %v", err)
-		return
+	// A missing or damaged file is treated as empty, the first time
+	conf, err := ReadFileSafe(GetDataPath()+"my.nettica.com-service-host.json", ValidJSON)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error reading service host config file: %v", err)
 	}
 
 	// compare the body to the current config and make no changes if they are the same
 	if bytes.Equal(conf, body) {
 		return
 	} else {
-		file, err := os.OpenFile(GetDataPath()+"my.nettica.com-service-host.json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-		if err != nil {
-			log.Errorf("Error opening my.nettica.com-service-host.json for write: %v", err)
-			return
-		}
-		_, err = file.Write(body)
-		file.Close()
+		err := WriteFileAtomic(GetDataPath()+"my.nettica.com-service-host.json", body, 0644)
 		if err != nil {
 			log.Infof("Error writing my.nettica.com-service-host.json file: %v", err)
 			return
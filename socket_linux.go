@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// StartSocket serves the local API on a Unix domain socket.  The socket is
+// only accessible to root and the members of cfg.SocketGroup, who can read
+// status.  Each connection is tagged with the caller's SO_PEERCRED
+// credentials.  Changes need root, our own user or cfg.SocketGroup, and keys
+// and configuration need root, our own user or cfg.SocketAdminGroup.
+func StartSocket(path string) {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		log.Errorf("Error creating socket directory %s: %v", filepath.Dir(path), err)
+		return
+	}
+
+	// Remove a stale socket from a previous run
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Errorf("Error listening on %s: %v", path, err)
+		return
+	}
+	defer listener.Close()
+
+	gid := -1
+	group, err := user.LookupGroup(cfg.SocketGroup)
+	if err != nil {
+		log.Warnf("Group %s not found, %s is only accessible to root: %v", cfg.SocketGroup, path, err)
+	} else {
+		gid, _ = strconv.Atoi(group.Gid)
+	}
+
+	err = os.Chown(path, 0, gid)
+	if err != nil {
+		log.Errorf("Error setting owner of %s: %v", path, err)
+	}
+
+	mode := os.FileMode(0600)
+	if gid != -1 {
+		mode = 0660
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		log.Errorf("Error setting permissions of %s: %v", path, err)
+		return
+	}
+
+	server := &http.Server{
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			cred, err := peerCredentials(c)
+			if err != nil {
+				log.Errorf("Error reading peer credentials: %v", err)
+				return ctx
+			}
+			return context.WithValue(ctx, peerCredKey{}, cred)
+		},
+	}
+
+	log.Infof("Starting web server on %s", path)
+
+	err = server.Serve(listener)
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// peerCredentials returns the process credentials of the other end of a Unix socket
+func peerCredentials(c net.Conn) (*PeerCred, error) {
+
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, unix.EINVAL
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, serr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+
+	return &PeerCred{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
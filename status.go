@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// PollState records the outcome of a Worker's polls for the status API
+type PollState struct {
+	mu          sync.Mutex
+	lastAttempt time.Time
+	lastSuccess time.Time
+	etag        string
+	errors      int
+	lastError   string
+}
+
+// PollStatus is the read-only view of a PollState
+type PollStatus struct {
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Etag        string     `json:"etag,omitempty"`
+	Errors      int        `json:"errors"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// Success records a successful poll
+func (p *PollState) Success(etag string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastAttempt = time.Now()
+	p.lastSuccess = p.lastAttempt
+	p.etag = etag
+}
+
+// Failure records a failed poll.  The error count is never reset so
+// monitoring can track it as a counter.
+func (p *PollState) Failure(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastAttempt = time.Now()
+	p.errors++
+	if err != nil {
+		p.lastError = err.Error()
+	}
+}
+
+// Status returns a copy of the current state
+func (p *PollState) Status() PollStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := PollStatus{
+		Etag:      p.etag,
+		Errors:    p.errors,
+		LastError: p.lastError,
+	}
+	if !p.lastAttempt.IsZero() {
+		t := p.lastAttempt
+		status.LastAttempt = &t
+	}
+	if !p.lastSuccess.IsZero() {
+		t := p.lastSuccess
+		status.LastSuccess = &t
+	}
+
+	return status
+}
+
+// Status is the full state of the daemon returned by GET /status
+type Status struct {
+	Version       string          `json:"version"`
+	Platform      string          `json:"platform"`
+	Time          time.Time       `json:"time"`
+	Servers       []ServerStatus  `json:"servers"`
+	DNS           DNSStatus       `json:"dns"`
+	Services      []ServiceStatus `json:"services,omitempty"`
+	KeystoreError string          `json:"keystoreError,omitempty"`
+}
+
+// ServerStatus describes one control plane and the VPNs it manages
+type ServerStatus struct {
+	Name        string         `json:"name"`
+	Path        string         `json:"path"`
+	Host        string         `json:"host"`
+	DeviceID    string         `json:"deviceid"`
+	Running     bool           `json:"running"`
+	Push        bool           `json:"push"`
+	Poll        PollStatus     `json:"poll"`
+	FailSafe    FailSafeStatus `json:"failsafe"`
+	Backoff     BackoffStatus  `json:"backoff"`
+	ServiceHost *BackoffStatus `json:"serviceHost,omitempty"`
+	VPNs        []VPNStatus    `json:"vpns"`
+}
+
+// VPNStatus compares what the server wants for a VPN with what is running
+type VPNStatus struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	NetName string `json:"netName"`
+	Desired bool   `json:"desired"`
+	Running bool   `json:"running"`
+	InSync  bool   `json:"inSync"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DNSStatus describes the DNS servers and where queries are forwarded
+type DNSStatus struct {
+	Servers       []string            `json:"servers"`
+	Resolvers     []string            `json:"resolvers"`
+	SearchDomains []string            `json:"searchDomains"`
+	Entries       int                 `json:"entries"`
+	Strategies    map[string]string   `json:"strategies,omitempty"`
+	Filtering     map[string]bool     `json:"filtering,omitempty"`
+	Forwarders    map[string][]string `json:"forwarders,omitempty"`
+	Bridges       map[string]string   `json:"mdns,omitempty"`
+	Imported      int                 `json:"imported,omitempty"`
+	Upstreams     []UpstreamStatus    `json:"upstreams"`
+}
+
+// ServiceStatus describes a service host container
+type ServiceStatus struct {
+	Server      string `json:"server"`
+	Id          string `json:"id"`
+	ContainerId string `json:"containerId"`
+	Status      string `json:"status"`
+	Running     bool   `json:"running"`
+}
+
+// GetStatus collects the state of every server, VPN, DNS server and container
+func GetStatus() Status {
+
+	status := Status{
+		Version:  Version,
+		Platform: Platform(),
+		Time:     time.Now(),
+		Servers:  []ServerStatus{},
+	}
+
+	// Take a copy of the list so slow checks don't hold the lock
+	ServersMutex.Lock()
+	servers := make([]*Server, 0, len(Servers))
+	for _, s := range Servers {
+		servers = append(servers, s)
+	}
+	ServersMutex.Unlock()
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+
+	for _, s := range servers {
+		status.Servers = append(status.Servers, GetServerStatus(s))
+		if ServiceHost {
+			status.Services = append(status.Services, GetServiceStatus(s)...)
+		}
+	}
+
+	status.DNS = GetDNSStatus()
+
+	if err := KeystoreError(); err != nil {
+		status.KeystoreError = err.Error()
+	}
+
+	return status
+}
+
+// GetServerStatus reports the poll, failsafe and VPN state for a server
+func GetServerStatus(s *Server) ServerStatus {
+
+	status := ServerStatus{
+		Name: s.Name,
+		Path: s.Path,
+		VPNs: []VPNStatus{},
+	}
+
+	var msg model.Message
+	err := json.NewDecoder(bytes.NewReader(s.GetBody())).Decode(&msg)
+	if err != nil {
+		log.Debugf("Error decoding config for %s: %v", s.Name, err)
+	}
+
+	if msg.Device != nil {
+		status.Host = msg.Device.Server
+		status.DeviceID = msg.Device.Id
+	}
+
+	if s.Worker != nil {
+		status.Running = true
+		status.Push = s.Worker.PushConnected()
+		status.Poll = s.Worker.poll.Status()
+		status.FailSafe = s.Worker.failsafe.Status()
+		status.Backoff = s.Worker.backoff.Status()
+	}
+
+	if ServiceHost {
+		serviceHost := s.ServiceBackoff.Status()
+		status.ServiceHost = &serviceHost
+	}
+
+	for i := 0; i < len(msg.Config); i++ {
+		for j := 0; j < len(msg.Config[i].VPNs); j++ {
+			vpn := msg.Config[i].VPNs[j]
+			if vpn.DeviceID != status.DeviceID {
+				continue
+			}
+
+			v := VPNStatus{
+				Id:      vpn.Id,
+				Name:    vpn.Name,
+				NetName: vpn.NetName,
+				Desired: vpn.Enable,
+			}
+			v.Running, err = IsWireguardRunning(vpn.NetName)
+			if err != nil && vpn.Enable {
+				v.Error = err.Error()
+			}
+			v.InSync = v.Desired == v.Running
+			status.VPNs = append(status.VPNs, v)
+		}
+	}
+
+	return status
+}
+
+// GetDNSStatus reports the running DNS servers and the upstream resolvers
+func GetDNSStatus() DNSStatus {
+
+	globalLock.Lock()
+	defer globalLock.Unlock()
+
+	status := DNSStatus{
+		Servers:       []string{},
+		Resolvers:     UpstreamNames(global.Resolvers),
+		SearchDomains: append([]string{}, global.SearchDomains...),
+		Entries:       global.Zone.Len(),
+		Strategies:    make(map[string]string),
+		Filtering:     make(map[string]bool),
+		Forwarders:    ForwarderNames(global.Forwarders),
+		Bridges:       make(map[string]string),
+		Imported:      mdnsBridge.Len(),
+		Upstreams:     []UpstreamStatus{},
+	}
+	for address, strategy := range global.Strategies {
+		status.Strategies[address] = strategy
+	}
+	for netName, site := range global.Bridges {
+		status.Bridges[netName] = site
+	}
+	for address := range global.DnsServers {
+		status.Filtering[address] = filteringFor(address)
+	}
+	for _, u := range global.Resolvers {
+		status.Upstreams = append(status.Upstreams, u.Status())
+	}
+	for address, server := range global.DnsServers {
+		if server != nil {
+			status.Servers = append(status.Servers, address)
+		}
+	}
+	sort.Strings(status.Servers)
+
+	return status
+}
+
+// GetServiceStatus reports the containers a service host is running for a server
+func GetServiceStatus(s *Server) []ServiceStatus {
+
+	services := []ServiceStatus{}
+
+	// A plain read, a status request mustn't restore files from backups
+	path := strings.TrimSuffix(s.Path, ".json") + "-service-host.json"
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return services
+	}
+
+	var msg model.ServiceMessage
+	err = json.NewDecoder(bytes.NewReader(body)).Decode(&msg)
+	if err != nil {
+		log.Errorf("Error unmarshalling service host config file: %v", err)
+		return services
+	}
+
+	for _, service := range msg.Config {
+		services = append(services, ServiceStatus{
+			Server:      s.Name,
+			Id:          service.Id,
+			ContainerId: service.ContainerId,
+			Status:      service.Status,
+			Running:     service.ContainerId != "" && CheckContainer(service),
+		})
+	}
+
+	return services
+}
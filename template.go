@@ -12,8 +12,8 @@ var (
 	clientTpl = `[Interface]
 Address = {{ StringsJoin .Host.Current.Address ", " }}
 PrivateKey = {{ .Host.Current.PrivateKey }}
-{{ if ne (len .Server.Dns) 0 -}}
-DNS = {{ StringsJoin .Server.Dns ", " }}
+{{ with WireguardDNS .Server.Dns -}}
+DNS = {{ StringsJoin . ", " }}
 {{- end }}
 {{ if ne .Server.Mtu 0 -}}
 MTU = {{.Server.Mtu}}
@@ -35,7 +35,7 @@ Address = {{ . }}
 PrivateKey = {{ .Key }}
 {{ $server := .Vpn.Current.Endpoint -}}{{ $service := .Vpn.Type -}}
 {{ if ne .Vpn.Current.ListenPort 0 -}}ListenPort = {{ .Vpn.Current.ListenPort }}{{- end}}
-{{ if .Vpn.Current.Dns }}DNS = {{ StringsJoin .Vpn.Current.Dns ", " }}{{ end }}
+{{ with WireguardDNS .Vpn.Current.Dns }}DNS = {{ StringsJoin . ", " }}{{ end }}
 {{ if .Vpn.Current.Table }}Table = {{ .Vpn.Current.Table }}{{- end}}
 {{ if ne .Vpn.Current.Mtu 0 -}}MTU = {{.Vpn.Current.Mtu}}{{- end}}
 {{ if .Vpn.Current.PreUp -}}PreUp = {{ .Vpn.Current.PreUp }}{{- end}}
@@ -68,9 +68,29 @@ AllowedIPs = {{ StringsJoin .Current.AllowedIPs ", " }}
 {{ end }}`
 )
 
+var templateFuncs = template.FuncMap{
+	"StringsJoin":  strings.Join,
+	"WireguardDNS": WireguardDNS,
+}
+
+// WireguardDNS returns the entries of a DNS list that wg-quick and the
+// tunnel services understand: plain addresses and search domains.  DNS
+// over TLS and HTTPS resolvers and forwarding rules are only used by our
+// own DNS server.
+func WireguardDNS(entries []string) []string {
+	dns := []string{}
+	for _, entry := range entries {
+		if strings.Contains(entry, "://") || IsForwardRule(entry) {
+			continue
+		}
+		dns = append(dns, entry)
+	}
+	return dns
+}
+
 // DumpWireguardConfig using go template
 func DumpWireguardConfig(key string, vpn *model.VPN, VPNs *[]model.VPN) ([]byte, error) {
-	t, err := template.New("wireguard").Funcs(template.FuncMap{"StringsJoin": strings.Join}).Parse(wireguardTemplate)
+	t, err := template.New("wireguard").Funcs(templateFuncs).Parse(wireguardTemplate)
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +108,7 @@ func DumpWireguardConfig(key string, vpn *model.VPN, VPNs *[]model.VPN) ([]byte,
 
 // DumpClientWg dump client wg config with go template
 func DumpClientWg(vpn *model.VPN, server *model.Server) ([]byte, error) {
-	t, err := template.New("client").Funcs(template.FuncMap{"StringsJoin": strings.Join}).Parse(clientTpl)
+	t, err := template.New("client").Funcs(templateFuncs).Parse(clientTpl)
 	if err != nil {
 		return nil, err
 	}
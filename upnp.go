@@ -1,11 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"strings"
+	"time"
 
 	"github.com/huin/goupnp/dcps/internetgateway1"
-	"github.com/nettica-com/nettica-admin/model"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,143 +31,115 @@ func isBogon(ip string) bool {
 	return false
 }
 
-func ConfigureUPnP(vpn model.VPN) error {
+// igdClient is what the WANIPConnection1 and WANPPPConnection1 clients
+// have in common
+type igdClient interface {
+	GetExternalIPAddress() (string, error)
+	AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error
+	DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error
+}
+
+// upnpMapper maps ports with UPnP IGD v1 on every gateway that answers
+type upnpMapper struct {
+	clients []igdClient
+}
+
+// NewUPnPMapper discovers the UPnP gateways, or returns an error if there
+// are none
+func NewUPnPMapper() (PortMapper, error) {
+
+	m := &upnpMapper{}
+
+	log.Infof("***UPNP*** Discovering UPnP gateways")
+	clients, _, err := internetgateway1.NewWANIPConnection1Clients()
+	if err != nil {
+		log.Errorf("WAN Error discovering gateway, upnp likely not supported. %v", err)
+	}
+	for _, c := range clients {
+		m.clients = append(m.clients, c)
+	}
+
+	ppp, _, err := internetgateway1.NewWANPPPConnection1Clients()
+	if err != nil { // no ppp connection
+		log.Debugf("Error discovering PPP gateway, likely does not exist. %v", err)
+	}
+	for _, c := range ppp {
+		m.clients = append(m.clients, c)
+	}
+
+	if len(m.clients) == 0 {
+		return nil, errors.New("no UPnP gateway found")
+	}
+
+	return m, nil
+}
 
-	if vpn.Current.UPnP {
+func (m *upnpMapper) Name() string { return "UPnP" }
 
-		log.Infof("***UPNP*** Configuring UPnP for %s", vpn.Name)
-		clients, _, err := internetgateway1.NewWANIPConnection1Clients()
+func (m *upnpMapper) ExternalAddress() (net.IP, error) {
 
+	var err error
+	for _, c := range m.clients {
+		var externalIP string
+		externalIP, err = c.GetExternalIPAddress()
 		if err != nil {
-			log.Errorf("WAN Error discovering gateway, upnp likely not supported. %v", err)
-		}
-		if len(clients) == 0 {
-			log.Error("***UPNP***WAN No gateway found, upnp likely not supported.")
+			log.Errorf("Error getting external ip address, %v", err)
+			continue
 		}
-		for _, c := range clients {
-
-			if vpn.Current.ListenPort != 0 && vpn.Current.Endpoint != "" {
-				// get local ip address
-				conn, err := net.Dial("udp", "8.8.8.8:53")
-				if err != nil {
-					log.Error("Impossible to get local ip address")
-				} else {
-					defer conn.Close()
-					localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-					// get the external ip address
-					externalIP, err := c.GetExternalIPAddress()
-					if err != nil {
-						log.Errorf("Error getting external ip address, %v", err)
-					} else {
-						log.Infof("***UPNP*** External IP address: %s", externalIP)
-						// compare the externalIP to the endpoint
-						parts := strings.Split(vpn.Current.Endpoint, ":")
-						if parts[0] != externalIP && !isBogon(externalIP) {
-							log.Error("External IP address does not match endpoint")
-							// Update the vpn endpoint at nettica
-							vpn.Current.Endpoint = externalIP + ":" + parts[1]
-
-							if !vpn.Current.SyncEndpoint {
-								UpdateVPN(&vpn)
-							}
-						}
-					}
-
-					// delete any old port mappings
-					err = c.DeletePortMapping("", uint16(vpn.Current.ListenPort), "UDP")
-					if err != nil {
-						log.Errorf("Error deleting port mapping, %v", err)
-					}
-
-					log.Infof("***UPNP*** AddPortMapping: %d %s %d %s %s", vpn.Current.ListenPort, "UDP", vpn.Current.ListenPort, localAddr.IP.String(), vpn.Name+"-"+vpn.NetName)
-					// add port mapping
-					err = c.AddPortMapping("", uint16(vpn.Current.ListenPort), "UDP", uint16(vpn.Current.ListenPort), localAddr.IP.String(), true, vpn.Name+"-"+vpn.NetName, 0)
-					if err != nil {
-						log.Errorf("Error adding port mapping, %v", err)
-					}
-				}
-			}
+		if ip := net.ParseIP(externalIP); ip != nil && !isBogon(externalIP) {
+			return ip, nil
 		}
+	}
+	if err == nil {
+		err = errors.New("no external address")
+	}
 
-		ppp, _, err := internetgateway1.NewWANPPPConnection1Clients()
-		if err != nil { // no ppp connection
-			log.Errorf("Error discovering PPP gateway, likely doesn not exist. %v", err)
-			return err
-		}
-		if len(ppp) == 0 {
-			log.Error("No PPP gateway found, likely does not exist.")
-			return err
+	return nil, err
+}
+
+func (m *upnpMapper) AddMapping(port uint16, lifetime time.Duration, description string) (PortMapping, error) {
+
+	// get local ip address
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("impossible to get local ip address: %v", err)
+	}
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	conn.Close()
+
+	// many gateways only support permanent mappings, so they are renewed
+	// rather than left to expire
+	mapped := false
+	for _, c := range m.clients {
+		// delete any old port mappings
+		err = c.DeletePortMapping("", port, "UDP")
+		if err != nil {
+			log.Debugf("Error deleting port mapping, %v", err)
 		}
 
-		log.Info("PPP gateway found, configuring external IP and port mapping.")
-
-		for _, c := range ppp {
-
-			if vpn.Current.ListenPort != 0 && vpn.Current.Endpoint != "" {
-				// get local ip address
-				conn, err := net.Dial("udp", "8.8.8.8:53")
-				if err != nil {
-					log.Error("Impossible to get local ip address")
-				} else {
-					defer conn.Close()
-					localAddr := conn.LocalAddr().(*net.UDPAddr)
-
-					// get the external ip address
-					externalIP, err := c.GetExternalIPAddress()
-					if err != nil {
-						log.Errorf("PPP Error getting external ip address, %v", err)
-					} else {
-						log.Infof("***UPNP***PPP External IP address: %s", externalIP)
-						// compare the externalIP to the endpoint
-						parts := strings.Split(vpn.Current.Endpoint, ":")
-						if parts[0] != externalIP && !isBogon(externalIP) {
-							log.Error("PPP External IP address does not match endpoint")
-							// Update the vpn endpoint at nettica
-							vpn.Current.Endpoint = externalIP + ":" + parts[1]
-							if !vpn.Current.SyncEndpoint {
-								UpdateVPN(&vpn)
-							}
-						}
-					}
-
-					// delete any old port mappings
-					err = c.DeletePortMapping("", uint16(vpn.Current.ListenPort), "UDP")
-					if err != nil {
-						log.Errorf("PPP Error deleting port mapping, %v", err)
-					}
-
-					log.Infof("***UPNP***PPP AddPortMapping: %d %s %d %s %s", vpn.Current.ListenPort, "UDP", vpn.Current.ListenPort, localAddr.IP.String(), vpn.Name+"-"+vpn.NetName)
-					// add port mapping
-					err = c.AddPortMapping("", uint16(vpn.Current.ListenPort), "UDP", uint16(vpn.Current.ListenPort), localAddr.IP.String(), true, vpn.Name+"-"+vpn.NetName, 0)
-					if err != nil {
-						log.Errorf("PPP Error adding port mapping, %v", err)
-					}
-				}
-			}
+		log.Infof("***UPNP*** AddPortMapping: %d %s %d %s %s", port, "UDP", port, localAddr.IP.String(), description)
+		err = c.AddPortMapping("", port, "UDP", port, localAddr.IP.String(), true, description, 0)
+		if err != nil {
+			log.Errorf("Error adding port mapping, %v", err)
+			continue
 		}
+		mapped = true
+	}
+	if !mapped {
+		return PortMapping{}, err
 	}
 
-	return nil
+	return PortMapping{InternalPort: port, ExternalPort: port}, nil
 }
 
-func UpdateVPN(vpn *model.VPN) error {
-	// Update the vpn at nettica
-
-	for _, s := range Servers {
-		if s.Worker != nil {
-			v, _, err := s.Worker.FindVPN(vpn.NetName)
-			if err != nil {
-				log.Errorf("Error finding vpn: %v", err)
-			}
-			if v != nil {
-				err = s.Worker.UpdateVPN(vpn)
-				if err != nil {
-					log.Errorf("Error updating vpn: %v", err)
-				}
-				return err
-			}
+func (m *upnpMapper) DeleteMapping(port uint16) error {
+
+	var err error
+	for _, c := range m.clients {
+		if e := c.DeletePortMapping("", port, "UDP"); e != nil {
+			err = e
 		}
 	}
-	return nil
+
+	return err
 }
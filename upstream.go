@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Upstream resolvers.
+//
+// Entries in a VPN's DNS list are either search domains or resolvers.  A
+// resolver is a plain IP address (UDP/TCP port 53), a tls://host[:port]
+// URL for DNS over TLS (RFC 7858), or an https:// URL for DNS over HTTPS
+// (RFC 8484).  Host names in encrypted upstreams are looked up with the
+// system resolver, or cfg.DNSBootstrap if it is set.  The system resolver
+// keeps those lookups off a third party, but it is often us: a lookup of
+// a resolver's own name that comes back while we're dialing it can't be
+// sent to it, and is left to the other resolvers.  Give the resolver as an
+// IP address, or set a bootstrap resolver, if there are none.
+
+const (
+	UpstreamPlain = "dns"
+	UpstreamTLS   = "tls"
+	UpstreamHTTPS = "https"
+
+	upstreamTimeout          = 1000 * time.Millisecond
+	upstreamEncryptedTimeout = 3000 * time.Millisecond
+	upstreamTLSIdle          = 4 // idle DNS over TLS connections kept per resolver
+
+	// Resolvers that fail this many times in a row are demoted, first for
+	// upstreamDemoteMin and doubling up to upstreamDemoteMax
+	upstreamDemoteAfter = 3
+	upstreamDemoteMin   = 30 * time.Second
+	upstreamDemoteMax   = 5 * time.Minute
+
+	// How the resolvers in a tier are queried
+	StrategySequential = "sequential"
+	StrategyParallel   = "parallel"
+)
+
+// Upstream is a resolver that queries are forwarded to
+type Upstream struct {
+	Kind    string // UpstreamPlain, UpstreamTLS or UpstreamHTTPS
+	Address string // host:port, or the URL for DNS over HTTPS
+	Host    string // host name or address, used for the TLS server name
+	IP      net.IP // nil if Host is a name
+
+	name string
+
+	mu      sync.Mutex
+	conns   []*dns.Conn  // idle DNS over TLS connections
+	client  *http.Client // DNS over HTTPS client
+	dialing atomic.Int32 // connections being dialed
+
+	health upstreamHealth
+}
+
+// upstreamHealth tracks how well a resolver has been answering
+type upstreamHealth struct {
+	mu        sync.Mutex
+	latency   time.Duration // moving average of successful queries
+	failures  int           // consecutive failures
+	errors    int           // total failures
+	queries   int           // total queries
+	demoted   time.Time     // skip the resolver until this time
+	lastError string
+}
+
+// UpstreamStatus is the read-only view of a resolver's health for the local API
+type UpstreamStatus struct {
+	Resolver  string     `json:"resolver"`
+	Kind      string     `json:"kind"`
+	Internal  bool       `json:"internal"`
+	Latency   string     `json:"latency,omitempty"`
+	Queries   int        `json:"queries"`
+	Errors    int        `json:"errors"`
+	Failures  int        `json:"failures"`
+	Demoted   *time.Time `json:"demoted,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+var (
+	upstreams     = make(map[string]*Upstream)
+	upstreamsLock sync.Mutex
+)
+
+// IsUpstream returns true if an entry in the DNS list is a resolver rather
+// than a search domain
+func IsUpstream(s string) bool {
+	return net.ParseIP(s) != nil || strings.Contains(s, "://")
+}
+
+// GetUpstream parses a resolver entry.  Upstreams are shared so
+// connections survive configuration updates.
+func GetUpstream(s string) (*Upstream, error) {
+
+	upstreamsLock.Lock()
+	defer upstreamsLock.Unlock()
+
+	if u, found := upstreams[s]; found {
+		return u, nil
+	}
+
+	u, err := ParseUpstream(s)
+	if err != nil {
+		return nil, err
+	}
+	upstreams[s] = u
+
+	return u, nil
+}
+
+// ParseUpstream parses an IP address, tls:// or https:// URL
+func ParseUpstream(s string) (*Upstream, error) {
+
+	if ip := net.ParseIP(s); ip != nil {
+		return &Upstream{Kind: UpstreamPlain, Address: net.JoinHostPort(s, "53"), Host: s, IP: ip, name: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid resolver %s", s)
+	}
+
+	upstream := &Upstream{Host: u.Hostname(), IP: net.ParseIP(u.Hostname()), name: s}
+
+	switch strings.ToLower(u.Scheme) {
+	case "tls":
+		port := u.Port()
+		if port == "" {
+			port = "853"
+		}
+		upstream.Kind = UpstreamTLS
+		upstream.Address = net.JoinHostPort(upstream.Host, port)
+
+	case "https":
+		upstream.Kind = UpstreamHTTPS
+		upstream.Address = u.String()
+		upstream.client = &http.Client{
+			Timeout: upstreamEncryptedTimeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         upstream.dialContext,
+				TLSHandshakeTimeout: upstreamEncryptedTimeout,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConns:        4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported resolver %s", s)
+	}
+
+	return upstream, nil
+}
+
+func (u *Upstream) String() string {
+	return u.name
+}
+
+// Internal returns true for resolvers on private or loopback addresses,
+// which are queried before public ones
+func (u *Upstream) Internal() bool {
+	return u.IP != nil && (u.IP.IsPrivate() || u.IP.IsLoopback())
+}
+
+// Exchange sends a query to the upstream.  network is the transport the
+// query arrived on and only matters for plain resolvers.
+func (u *Upstream) Exchange(q *dns.Msg, network string) (*dns.Msg, error) {
+
+	// Our own lookup of the resolver's name, see above
+	if u.IP == nil && u.dialing.Load() > 0 && len(q.Question) > 0 && strings.EqualFold(q.Question[0].Name, dns.Fqdn(u.Host)) {
+		return nil, fmt.Errorf("%s is being looked up to connect to it", u.Host)
+	}
+
+	start := time.Now()
+
+	var r *dns.Msg
+	var err error
+	switch u.Kind {
+	case UpstreamTLS:
+		r, err = u.exchangeTLS(q)
+	case UpstreamHTTPS:
+		r, err = u.exchangeHTTPS(q)
+	default:
+		r, err = MakeQuery(u.Address, network, q)
+		// Answers too large for UDP are asked for again over TCP
+		if err == nil && r.Truncated && network != "tcp" {
+			r, err = MakeQuery(u.Address, "tcp", q)
+		}
+	}
+
+	if err != nil {
+		metrics.Add("nettica_dns_upstream_errors_total", Labels("resolver", u.String()), 1)
+		u.failure(err)
+		return nil, err
+	}
+	took := time.Since(start)
+	metrics.Observe("nettica_dns_upstream_duration_seconds", Labels("resolver", u.String()), took)
+
+	// A resolver that can't answer is as bad as one that doesn't
+	if r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused {
+		u.failure(errors.New(dns.RcodeToString[r.Rcode]))
+	} else {
+		u.success(took)
+	}
+
+	return r, nil
+}
+
+func (u *Upstream) success(took time.Duration) {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+
+	h := &u.health
+	h.queries++
+	if h.latency == 0 {
+		h.latency = took
+	} else {
+		h.latency = (h.latency*7 + took) / 8
+	}
+	if h.failures >= upstreamDemoteAfter {
+		log.Infof("DNS resolver %s has recovered", u)
+	}
+	h.failures = 0
+	h.demoted = time.Time{}
+}
+
+func (u *Upstream) failure(err error) {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+
+	h := &u.health
+	h.queries++
+	h.errors++
+	h.failures++
+	h.lastError = err.Error()
+
+	if h.failures >= upstreamDemoteAfter {
+		d := upstreamDemoteMin
+		for i := upstreamDemoteAfter; i < h.failures && d < upstreamDemoteMax; i++ {
+			d *= 2
+		}
+		if d > upstreamDemoteMax {
+			d = upstreamDemoteMax
+		}
+		if h.demoted.IsZero() || time.Now().After(h.demoted) {
+			log.Warnf("DNS resolver %s demoted for %v after %d failures (%s)", u, d, h.failures, h.lastError)
+		}
+		h.demoted = time.Now().Add(d)
+	}
+}
+
+// Demoted returns true if the resolver has been failing and should only
+// be used when nothing else is available
+func (u *Upstream) Demoted() bool {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+
+	return time.Now().Before(u.health.demoted)
+}
+
+// Status returns a copy of the resolver's health
+func (u *Upstream) Status() UpstreamStatus {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+
+	h := &u.health
+	status := UpstreamStatus{
+		Resolver:  u.String(),
+		Kind:      u.Kind,
+		Internal:  u.Internal(),
+		Queries:   h.queries,
+		Errors:    h.errors,
+		Failures:  h.failures,
+		LastError: h.lastError,
+	}
+	if h.latency > 0 {
+		status.Latency = h.latency.Round(time.Microsecond).String()
+	}
+	if time.Now().Before(h.demoted) {
+		demoted := h.demoted
+		status.Demoted = &demoted
+	}
+
+	return status
+}
+
+// QueryUpstreams asks a tier of resolvers for an answer.  Resolvers that
+// have been demoted are tried last, or only if every resolver in the tier
+// is demoted when racing.  It returns the successful response if there is
+// one, otherwise the last NXDOMAIN.
+func QueryUpstreams(tier []*Upstream, query *dns.Msg, network string, strategy string) (*dns.Msg, *dns.Msg) {
+
+	healthy := []*Upstream{}
+	demoted := []*Upstream{}
+	for _, u := range tier {
+		if u.Demoted() {
+			demoted = append(demoted, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if strategy == StrategyParallel {
+		if len(healthy) == 0 {
+			healthy = demoted
+		}
+		return raceUpstreams(healthy, query, network)
+	}
+
+	var negative *dns.Msg
+	for _, u := range append(healthy, demoted...) {
+		response, err := u.Exchange(query, network)
+		if err != nil {
+			log.Errorf("*** Error: %s %s %v", u, query.Question[0].Name, err)
+			continue
+		}
+		if response.Rcode == dns.RcodeSuccess {
+			return response, nil
+		}
+		if response.Rcode == dns.RcodeNameError {
+			negative = response
+		}
+		log.Infof("--- Query to %s failed: %s %s", u, query.Question[0].Name, dns.RcodeToString[response.Rcode])
+	}
+
+	return nil, negative
+}
+
+// raceUpstreams queries every resolver at once and takes the first
+// successful answer.  Slower resolvers finish in the background so their
+// health is still recorded.
+func raceUpstreams(tier []*Upstream, query *dns.Msg, network string) (*dns.Msg, *dns.Msg) {
+
+	if len(tier) == 0 {
+		return nil, nil
+	}
+
+	type result struct {
+		upstream *Upstream
+		response *dns.Msg
+		err      error
+	}
+
+	results := make(chan result, len(tier))
+	for _, u := range tier {
+		go func(u *Upstream) {
+			// Each resolver gets its own copy as Exchange may modify the ID
+			response, err := u.Exchange(query.Copy(), network)
+			results <- result{upstream: u, response: response, err: err}
+		}(u)
+	}
+
+	var negative *dns.Msg
+	for i := 0; i < len(tier); i++ {
+		r := <-results
+		if r.err != nil {
+			log.Errorf("*** Error: %s %s %v", r.upstream, query.Question[0].Name, r.err)
+			continue
+		}
+		if r.response.Rcode == dns.RcodeSuccess {
+			r.response.Id = query.Id
+			return r.response, nil
+		}
+		if r.response.Rcode == dns.RcodeNameError {
+			negative = r.response
+		}
+		log.Infof("--- Query to %s failed: %s %s", r.upstream, query.Question[0].Name, dns.RcodeToString[r.response.Rcode])
+	}
+
+	return nil, negative
+}
+
+// StrategyFromTags returns the resolver strategy requested by a VPN's tags
+func StrategyFromTags(tags []string) string {
+	for _, tag := range tags {
+		switch strings.ToLower(tag) {
+		case "dns:" + StrategyParallel:
+			return StrategyParallel
+		case "dns:" + StrategySequential:
+			return StrategySequential
+		}
+	}
+	return ""
+}
+
+// exchangeTLS sends a query over a persistent DNS over TLS connection,
+// redialing once if the server has closed it.  Each query has a
+// connection to itself, idle ones are kept for the next query.
+func (u *Upstream) exchangeTLS(q *dns.Msg) (*dns.Msg, error) {
+
+	c := &dns.Client{
+		Net:     "tcp-tls",
+		Timeout: upstreamEncryptedTimeout,
+		Dialer:  bootstrapDialer(),
+		TLSConfig: &tls.Config{
+			ServerName: u.Host,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	conn, reused := u.getTLSConn()
+	for {
+		if conn == nil {
+			var err error
+			u.dialing.Add(1)
+			conn, err = c.Dial(u.Address)
+			u.dialing.Add(-1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		r, _, err := c.ExchangeWithConn(q, conn)
+		if err == nil {
+			u.putTLSConn(conn)
+			return r, nil
+		}
+		conn.Close()
+
+		// an idle connection may have been closed by the server
+		if !reused {
+			return nil, err
+		}
+		conn, reused = nil, false
+	}
+}
+
+// getTLSConn takes an idle connection, if there is one
+func (u *Upstream) getTLSConn() (*dns.Conn, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.conns) == 0 {
+		return nil, false
+	}
+	conn := u.conns[len(u.conns)-1]
+	u.conns = u.conns[:len(u.conns)-1]
+	return conn, true
+}
+
+// putTLSConn keeps a connection for the next query, or closes it if
+// enough are idle
+func (u *Upstream) putTLSConn(conn *dns.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.conns) >= upstreamTLSIdle {
+		conn.Close()
+		return
+	}
+	u.conns = append(u.conns, conn)
+}
+
+// exchangeHTTPS sends a query as an RFC 8484 POST
+func (u *Upstream) exchangeHTTPS(q *dns.Msg) (*dns.Msg, error) {
+
+	// The ID should be zero to make responses cacheable by HTTP caches
+	m := q.Copy()
+	m.Id = 0
+
+	buffer, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", u.Address, bytes.NewReader(buffer))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("User-Agent", "nettica-client/"+Version)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u.Address, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	err = r.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	r.Id = q.Id
+
+	return r, nil
+}
+
+// dialContext dials a DNS over HTTPS resolver
+func (u *Upstream) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	u.dialing.Add(1)
+	defer u.dialing.Add(-1)
+
+	return bootstrapDialer().DialContext(ctx, network, address)
+}
+
+// bootstrapDialer returns a dialer that resolves upstream host names with
+// the bootstrap resolver, or the system resolver if there isn't one
+func bootstrapDialer() *net.Dialer {
+	if cfg.DNSBootstrap == "" {
+		return &net.Dialer{Timeout: upstreamEncryptedTimeout}
+	}
+	return &net.Dialer{
+		Timeout: upstreamEncryptedTimeout,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: upstreamTimeout}
+				return d.DialContext(ctx, network, cfg.DNSBootstrap)
+			},
+		},
+	}
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 var reservedNames = []string{
@@ -74,3 +82,223 @@ func NameFromPath(path string) (string, error) {
 	}
 	return name, nil
 }
+
+// WireguardConfig is a parsed wg-quick style configuration file, as
+// written by DumpWireguardConfig
+type WireguardConfig struct {
+	Name       string
+	Address    []string
+	PrivateKey string
+	ListenPort int
+	Dns        []string
+	Mtu        int
+	Table      string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	Peers      []WireguardPeer
+}
+
+// WireguardPeer is a single [Peer] section
+type WireguardPeer struct {
+	Name                string
+	PublicKey           string
+	PresharedKey        string
+	AllowedIPs          []string
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+// ReadWireguardConfig reads and parses the configuration file for a net
+func ReadWireguardConfig(name string) (*WireguardConfig, error) {
+
+	text, err := os.ReadFile(GetWireguardPath() + Sanitize(name) + ".conf")
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseWireguardConfig(name, text)
+}
+
+// ParseWireguardConfig parses the text of a wg-quick configuration file
+func ParseWireguardConfig(name string, text []byte) (*WireguardConfig, error) {
+
+	conf := &WireguardConfig{Name: name}
+	var peer *WireguardPeer
+	section := ""
+	comment := ""
+
+	for n, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		// The template puts the name of the VPN in a comment above each section
+		if strings.HasPrefix(line, "#") {
+			comment = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[]"))
+			if section == "peer" {
+				conf.Peers = append(conf.Peers, WireguardPeer{Name: comment})
+				peer = &conf.Peers[len(conf.Peers)-1]
+			}
+			comment = ""
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s.conf line %d: expected key = value", name, n+1)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch section {
+		case "interface":
+			switch key {
+			case "address":
+				conf.Address = append(conf.Address, splitList(value)...)
+			case "privatekey":
+				conf.PrivateKey = value
+			case "listenport":
+				conf.ListenPort, _ = strconv.Atoi(value)
+			case "dns":
+				conf.Dns = append(conf.Dns, splitList(value)...)
+			case "mtu":
+				conf.Mtu, _ = strconv.Atoi(value)
+			case "table":
+				conf.Table = value
+			case "preup":
+				conf.PreUp = append(conf.PreUp, value)
+			case "postup":
+				conf.PostUp = append(conf.PostUp, value)
+			case "predown":
+				conf.PreDown = append(conf.PreDown, value)
+			case "postdown":
+				conf.PostDown = append(conf.PostDown, value)
+			}
+		case "peer":
+			switch key {
+			case "publickey":
+				peer.PublicKey = value
+			case "presharedkey":
+				peer.PresharedKey = value
+			case "allowedips":
+				peer.AllowedIPs = append(peer.AllowedIPs, splitList(value)...)
+			case "endpoint":
+				peer.Endpoint = value
+			case "persistentkeepalive":
+				peer.PersistentKeepalive, _ = strconv.Atoi(value)
+			}
+		default:
+			return nil, fmt.Errorf("%s.conf line %d: key outside of a section", name, n+1)
+		}
+	}
+
+	return conf, nil
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// PeerConfigs converts the peers to wgctrl form.  Peers present on the
+// running device but missing from the configuration are removed, all others
+// are added or updated in place so their sessions are not interrupted.
+func (c *WireguardConfig) PeerConfigs(current []wgtypes.Peer) ([]wgtypes.PeerConfig, error) {
+
+	peers := make([]wgtypes.PeerConfig, 0, len(c.Peers))
+	wanted := make(map[wgtypes.Key]bool)
+
+	for _, p := range c.Peers {
+		key, err := wgtypes.ParseKey(p.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: invalid public key: %v", p.Name, err)
+		}
+		wanted[key] = true
+
+		pc := wgtypes.PeerConfig{
+			PublicKey:         key,
+			ReplaceAllowedIPs: true,
+		}
+
+		if p.PresharedKey != "" {
+			psk, err := wgtypes.ParseKey(p.PresharedKey)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: invalid preshared key: %v", p.Name, err)
+			}
+			pc.PresharedKey = &psk
+		}
+
+		if p.Endpoint != "" {
+			endpoint, err := net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				// Leave the endpoint alone, the peer may still reach us
+				log.Errorf("peer %s: could not resolve endpoint %s: %v", p.Name, p.Endpoint, err)
+			} else {
+				pc.Endpoint = endpoint
+			}
+		}
+
+		keepalive := time.Duration(p.PersistentKeepalive) * time.Second
+		pc.PersistentKeepaliveInterval = &keepalive
+
+		for _, a := range p.AllowedIPs {
+			ipnet, err := ParsePrefix(a)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s: invalid allowed ip %s: %v", p.Name, a, err)
+			}
+			ipnet.IP = ipnet.IP.Mask(ipnet.Mask)
+			pc.AllowedIPs = append(pc.AllowedIPs, *ipnet)
+		}
+
+		peers = append(peers, pc)
+	}
+
+	for _, p := range current {
+		if !wanted[p.PublicKey] {
+			peers = append(peers, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+		}
+	}
+
+	return peers, nil
+}
+
+// ParsePrefix parses an address with or without a CIDR suffix.
+// A bare address is treated as a single host.
+func ParsePrefix(address string) (*net.IPNet, error) {
+
+	if !strings.Contains(address, "/") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", address)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	ip, ipnet, err := net.ParseCIDR(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the host bits, an interface address like 10.0.0.2/24 needs them
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: ipnet.Mask}, nil
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Native WireGuard management for Linux.
+//
+// Instead of shelling out to wg-quick, the interface is created over
+// netlink, configured with wgctrl and given its addresses and routes
+// directly.  Peers are applied with ConfigureDevice without ReplacePeers,
+// so updating one peer leaves the sessions of every other peer alone.
+// Routing for full tunnels follows wg-quick: the default route lives in
+// its own table selected by a firewall mark, so the two remain compatible.
+// Each full tunnel gets the first free table from defaultRouteTable up,
+// and uses its number as the mark.
+
+const (
+	defaultRouteTable = 51820
+	defaultMTU        = 1420
+)
+
+// nativeWireguard returns true unless the wg-quick backend has been selected
+func nativeWireguard() bool {
+	return cfg.WireguardBackend != "wg-quick"
+}
+
+// StartWireguardNative creates and configures the interface for a net
+func StartWireguardNative(netName string) error {
+
+	conf, err := ReadWireguardConfig(netName)
+	if err != nil {
+		return err
+	}
+
+	created := false
+	link, err := netlink.LinkByName(netName)
+	if err != nil {
+		runHooks(netName, conf.PreUp)
+
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = netName
+		err = netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs})
+		if err != nil {
+			return fmt.Errorf("creating interface %s: %v", netName, err)
+		}
+		created = true
+
+		link, err = netlink.LinkByName(netName)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ApplyWireguardNative(link, conf)
+	if err != nil {
+		if created {
+			netlink.LinkDel(link)
+		}
+		return err
+	}
+
+	if created {
+		runHooks(netName, conf.PostUp)
+	}
+
+	return nil
+}
+
+// ApplyWireguardNative brings a running interface in line with its configuration
+func ApplyWireguardNative(link netlink.Link, conf *WireguardConfig) error {
+
+	name := link.Attrs().Name
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	device, err := client.Device(name)
+	if err != nil {
+		return err
+	}
+
+	key, err := wgtypes.ParseKey(conf.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+
+	peers, err := conf.PeerConfigs(device.Peers)
+	if err != nil {
+		return err
+	}
+
+	config := wgtypes.Config{
+		PrivateKey: &key,
+		Peers:      peers,
+	}
+	if conf.ListenPort != 0 {
+		config.ListenPort = &conf.ListenPort
+	}
+
+	table, routed := routeTable(conf.Table)
+	fullTunnel := routed && table == unix.RT_TABLE_MAIN && hasDefaultRoute(conf)
+	previous := device.FirewallMark
+
+	// Pick the table and set the mark together, so two tunnels starting
+	// at once can't pick the same one
+	routeTablesLock.Lock()
+	mark := 0
+	if fullTunnel {
+		mark = previous
+		if mark == 0 {
+			mark, err = freeRouteTable(client)
+			if err != nil {
+				routeTablesLock.Unlock()
+				return fmt.Errorf("configuring %s: %v", name, err)
+			}
+		}
+	}
+	config.FirewallMark = &mark
+
+	err = client.ConfigureDevice(name, config)
+	routeTablesLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("configuring %s: %v", name, err)
+	}
+
+	mtu := conf.Mtu
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	if link.Attrs().MTU != mtu {
+		if err = netlink.LinkSetMTU(link, mtu); err != nil {
+			log.Errorf("Error setting MTU on %s: %v", name, err)
+		}
+	}
+
+	err = syncAddresses(link, conf.Address)
+	if err != nil {
+		return err
+	}
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return err
+	}
+
+	if routed {
+		err = syncRoutes(link, conf, table, mark, previous)
+		if err != nil {
+			return err
+		}
+	}
+	if previous != 0 && previous != mark {
+		removeDefaultRules(previous)
+	}
+
+	if len(conf.Dns) > 0 {
+		setResolvconf(name, conf.Dns)
+	}
+
+	return nil
+}
+
+// StopWireguardNative tears down the interface and everything attached to it
+func StopWireguardNative(netName string) error {
+
+	link, err := netlink.LinkByName(netName)
+	if err != nil {
+		return fmt.Errorf("%s is not running: %v", netName, err)
+	}
+
+	// The file may already be gone, in which case there are no hooks to run
+	conf, err := ReadWireguardConfig(netName)
+	if err != nil {
+		conf = &WireguardConfig{Name: netName}
+	}
+
+	runHooks(netName, conf.PreDown)
+
+	mark := wireguardMark(netName)
+
+	err = netlink.LinkDel(link)
+	if err != nil {
+		return fmt.Errorf("deleting interface %s: %v", netName, err)
+	}
+
+	if mark != 0 {
+		removeDefaultRules(mark)
+	}
+	clearResolvconf(netName)
+
+	runHooks(netName, conf.PostDown)
+
+	return nil
+}
+
+// IsWireguardRunningNative asks the kernel (or wireguard-go) if the device exists
+func IsWireguardRunningNative(netName string) bool {
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return false
+	}
+	defer client.Close()
+
+	_, err = client.Device(netName)
+	return err == nil
+}
+
+func syncAddresses(link netlink.Link, addresses []string) error {
+
+	wanted := make(map[string]*net.IPNet)
+	for _, a := range addresses {
+		ipnet, err := ParsePrefix(a)
+		if err != nil {
+			return err
+		}
+		wanted[ipnet.String()] = ipnet
+	}
+
+	current, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	for _, addr := range current {
+		if _, found := wanted[addr.IPNet.String()]; !found {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			log.Infof("Removing address %s from %s", addr.IPNet, link.Attrs().Name)
+			netlink.AddrDel(link, &addr)
+		}
+	}
+
+	for _, ipnet := range wanted {
+		err = netlink.AddrReplace(link, &netlink.Addr{IPNet: ipnet})
+		if err != nil {
+			return fmt.Errorf("adding address %s: %v", ipnet, err)
+		}
+	}
+
+	return nil
+}
+
+// routeTable interprets the Table setting the same way wg-quick does
+func routeTable(setting string) (int, bool) {
+
+	switch strings.ToLower(setting) {
+	case "", "auto", "main":
+		return unix.RT_TABLE_MAIN, true
+	case "off":
+		return 0, false
+	}
+
+	table, err := strconv.Atoi(setting)
+	if err != nil {
+		log.Errorf("Invalid Table %s, using main", setting)
+		return unix.RT_TABLE_MAIN, true
+	}
+	return table, true
+}
+
+func hasDefaultRoute(conf *WireguardConfig) bool {
+	for _, p := range conf.Peers {
+		for _, a := range p.AllowedIPs {
+			if a == "0.0.0.0/0" || a == "::/0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// syncRoutes installs the routes for the AllowedIPs in table.  A full
+// tunnel's default routes go in defaultTable instead, and routes left in
+// previousTable by an earlier configuration are removed.
+func syncRoutes(link netlink.Link, conf *WireguardConfig, table int, defaultTable int, previousTable int) error {
+
+	index := link.Attrs().Index
+	fullTunnel := defaultTable != 0
+
+	wanted := make(map[string]*netlink.Route)
+	for _, p := range conf.Peers {
+		for _, a := range p.AllowedIPs {
+			ipnet, err := ParsePrefix(a)
+			if err != nil {
+				continue
+			}
+			ipnet.IP = ipnet.IP.Mask(ipnet.Mask)
+
+			route := &netlink.Route{
+				LinkIndex: index,
+				Dst:       ipnet,
+				Table:     table,
+				Scope:     netlink.SCOPE_LINK,
+				Protocol:  unix.RTPROT_STATIC,
+			}
+
+			// Default routes go in their own table, see addDefaultRules
+			if ones, _ := ipnet.Mask.Size(); ones == 0 && fullTunnel {
+				route.Table = defaultTable
+			}
+
+			wanted[fmt.Sprintf("%d %s", route.Table, ipnet)] = route
+		}
+	}
+
+	// Remove routes we installed that are no longer in the configuration
+	tables := []int{table}
+	for _, t := range []int{defaultTable, previousTable} {
+		if t != 0 && !slices.Contains(tables, t) {
+			tables = append(tables, t)
+		}
+	}
+	for _, t := range tables {
+		filter := &netlink.Route{LinkIndex: index, Table: t, Protocol: unix.RTPROT_STATIC}
+		current, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			log.Errorf("Error listing routes for %s: %v", link.Attrs().Name, err)
+			continue
+		}
+		for _, r := range current {
+			dst := routeDst(&r)
+			if _, found := wanted[fmt.Sprintf("%d %s", r.Table, dst)]; !found {
+				log.Infof("Removing route %s from %s", dst, link.Attrs().Name)
+				netlink.RouteDel(&r)
+			}
+		}
+	}
+
+	for _, route := range wanted {
+		err := netlink.RouteReplace(route)
+		if err != nil {
+			return fmt.Errorf("adding route %s: %v", route.Dst, err)
+		}
+	}
+
+	if fullTunnel {
+		addDefaultRules(conf, defaultTable)
+	}
+
+	return nil
+}
+
+// routeDst returns a route's destination.  The kernel reports default
+// routes without one.
+func routeDst(r *netlink.Route) *net.IPNet {
+	if r.Dst != nil {
+		return r.Dst
+	}
+	if r.Family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// routeTablesLock serializes picking a full tunnel's table
+var routeTablesLock sync.Mutex
+
+// freeRouteTable returns the first table from defaultRouteTable up that
+// has no routes and isn't another WireGuard interface's mark, as wg-quick
+// chooses them.  routeTablesLock must be held.
+func freeRouteTable(client *wgctrl.Client) (int, error) {
+
+	marks := make(map[int]bool)
+	devices, err := client.Devices()
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range devices {
+		marks[d.FirewallMark] = true
+	}
+
+	for table := defaultRouteTable; table < defaultRouteTable+1024; table++ {
+		if marks[table] {
+			continue
+		}
+		used := false
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			if err != nil || len(routes) > 0 {
+				used = true
+			}
+		}
+		if !used {
+			return table, nil
+		}
+	}
+
+	return 0, errors.New("no free routing table for the full tunnel")
+}
+
+// wireguardMark returns the firewall mark of a WireGuard interface, which
+// is also its full tunnel table, or 0 if it has none
+func wireguardMark(netName string) int {
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return 0
+	}
+	defer client.Close()
+
+	device, err := client.Device(netName)
+	if err != nil {
+		return 0
+	}
+	return device.FirewallMark
+}
+
+// addDefaultRules sends everything not marked by WireGuard itself through
+// the tunnel's table, while still honoring more specific routes in main
+func addDefaultRules(conf *WireguardConfig, table int) {
+
+	families := map[int]bool{}
+	for _, p := range conf.Peers {
+		for _, a := range p.AllowedIPs {
+			if a == "0.0.0.0/0" {
+				families[netlink.FAMILY_V4] = true
+			}
+			if a == "::/0" {
+				families[netlink.FAMILY_V6] = true
+			}
+		}
+	}
+
+	for family := range families {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Mark = uint32(table)
+		rule.Invert = true
+		rule.Table = table
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, unix.EEXIST) {
+			log.Errorf("Error adding fwmark rule: %v", err)
+		}
+
+		rule = netlink.NewRule()
+		rule.Family = family
+		rule.Table = unix.RT_TABLE_MAIN
+		rule.SuppressPrefixlen = 0
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, unix.EEXIST) {
+			log.Errorf("Error adding suppress_prefixlength rule: %v", err)
+		}
+	}
+
+	if families[netlink.FAMILY_V4] {
+		// Needed for the reply path of marked packets, as wg-quick does
+		err := os.WriteFile("/proc/sys/net/ipv4/conf/all/src_valid_mark", []byte("1"), 0644)
+		if err != nil {
+			log.Debugf("Could not set src_valid_mark: %v", err)
+		}
+	}
+}
+
+// removeDefaultRules removes a full tunnel's rule added by
+// addDefaultRules.  The suppress_prefixlength rule is shared by every full
+// tunnel, so it stays while another tunnel's rule is left.
+func removeDefaultRules(table int) {
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Mark = uint32(table)
+		rule.Invert = true
+		rule.Table = table
+		netlink.RuleDel(rule)
+
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			log.Errorf("Error listing rules: %v", err)
+			continue
+		}
+		shared := false
+		for _, r := range rules {
+			if r.Invert && r.Mark != 0 && r.Table == int(r.Mark) {
+				shared = true
+			}
+		}
+		if shared {
+			continue
+		}
+
+		rule = netlink.NewRule()
+		rule.Family = family
+		rule.Table = unix.RT_TABLE_MAIN
+		rule.SuppressPrefixlen = 0
+		netlink.RuleDel(rule)
+	}
+}
+
+// runHooks runs PreUp/PostUp/PreDown/PostDown commands with %i replaced by the interface name
+func runHooks(netName string, hooks []string) {
+
+	for _, hook := range hooks {
+		hook = strings.ReplaceAll(hook, "%i", netName)
+
+		cmd := exec.Command("/bin/bash", "-c", hook)
+		var out bytes.Buffer
+		cmd.Stderr = &out
+		err := cmd.Run()
+		if err != nil {
+			log.Errorf("Error running %s: %v (%s)", hook, err, out.String())
+		}
+	}
+}
+
+var resolvconfOrder = regexp.MustCompile(`^([A-Za-z0-9-]+)\*$`)
+
+// resolvconfPrefix mirrors wg-quick's interface naming for resolvconf
+func resolvconfPrefix() string {
+
+	text, err := os.ReadFile("/etc/resolvconf/interface-order")
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(text), "\n") {
+		match := resolvconfOrder.FindStringSubmatch(strings.TrimSpace(line))
+		if match != nil {
+			return match[1] + "."
+		}
+	}
+
+	return ""
+}
+
+func setResolvconf(netName string, dns []string) {
+
+	if _, err := exec.LookPath("resolvconf"); err != nil {
+		log.Errorf("resolvconf not found, DNS for %s not configured", netName)
+		return
+	}
+
+	var b strings.Builder
+	search := []string{}
+	for _, d := range dns {
+		if net.ParseIP(d) != nil {
+			fmt.Fprintf(&b, "nameserver %s\n", d)
+		} else {
+			search = append(search, d)
+		}
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+
+	cmd := exec.Command("resolvconf", "-a", resolvconfPrefix()+netName, "-m", "0", "-x")
+	cmd.Stdin = strings.NewReader(b.String())
+	var out bytes.Buffer
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		log.Errorf("Error setting DNS for %s: %v (%s)", netName, err, out.String())
+	}
+}
+
+func clearResolvconf(netName string) {
+
+	if _, err := exec.LookPath("resolvconf"); err != nil {
+		return
+	}
+
+	cmd := exec.Command("resolvconf", "-d", resolvconfPrefix()+netName, "-f")
+	err := cmd.Run()
+	if err != nil {
+		log.Debugf("Error clearing DNS for %s: %v", netName, err)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// The mesh DNS zone.
+//
+// Each VPN gets A/AAAA records for its addresses and a PTR record for its
+// first address.  Further records come from the VPN's tags:
+//
+//	cname:<alias>                        <alias> is another name for the VPN
+//	srv:<_service._proto>:<port>[:<priority>:<weight>]
+//	                                     _service._proto.<vpn> points at the VPN
+//	txt:<text>                           a TXT record on the VPN's name
+//	rr:<record>                          any record in zone file format, eg.
+//	                                     rr:_http._tcp.mynet 60 SRV 0 0 80 web1.mynet.
+//
+// An alias without a dot is qualified with the network name.
+//
+// We are authoritative for each network name.  Its SOA and NS records are
+// synthesized, the NS records naming every VPN in the net that runs a DNS
+// server.
+
+const (
+	zoneDefaultTTL = 300
+	zoneMaxCNAME   = 8
+
+	zoneRefresh  = 3600
+	zoneRetry    = 600
+	zoneExpire   = 86400
+	zoneNegative = 60
+)
+
+// Zone holds the records answered by the Nettica DNS servers
+type Zone struct {
+	records map[string][]dns.RR // key is the lower case name without the trailing dot
+	origins map[string]bool     // the names we are authoritative for
+}
+
+// NewZone creates an empty zone
+func NewZone() *Zone {
+	return &Zone{records: make(map[string][]dns.RR), origins: make(map[string]bool)}
+}
+
+func zoneKey(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
+
+// Add adds a record, ignoring exact duplicates
+func (z *Zone) Add(rr dns.RR) {
+	key := zoneKey(rr.Header().Name)
+	rr.Header().Name = dns.Fqdn(key)
+	for _, existing := range z.records[key] {
+		if dns.IsDuplicate(existing, rr) {
+			return
+		}
+		// there can only be one SOA
+		if existing.Header().Rrtype == dns.TypeSOA && rr.Header().Rrtype == dns.TypeSOA {
+			return
+		}
+	}
+	z.records[key] = append(z.records[key], rr)
+}
+
+// AddAddress adds an A or AAAA record for an address, which may have a prefix length
+func (z *Zone) AddAddress(name string, address string) {
+	var ip net.IP
+	if strings.Contains(address, "/") {
+		ip, _, _ = net.ParseCIDR(address)
+	} else {
+		ip = net.ParseIP(address)
+	}
+	if ip == nil {
+		log.Errorf("Invalid address for %s: %s", name, address)
+		return
+	}
+
+	hdr := dns.RR_Header{Name: dns.Fqdn(name), Class: dns.ClassINET, Ttl: zoneDefaultTTL}
+	if ip.To4() != nil {
+		hdr.Rrtype = dns.TypeA
+		z.Add(&dns.A{Hdr: hdr, A: ip.To4()})
+	} else {
+		hdr.Rrtype = dns.TypeAAAA
+		z.Add(&dns.AAAA{Hdr: hdr, AAAA: ip.To16()})
+	}
+}
+
+// AddPTR adds a reverse record
+func (z *Zone) AddPTR(label string, target string) {
+	z.Add(&dns.PTR{Hdr: dns.RR_Header{Name: dns.Fqdn(label), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: zoneDefaultTTL},
+		Ptr: dns.Fqdn(target),
+	})
+}
+
+// AddTags adds the records described by a VPN's tags
+func (z *Zone) AddTags(name string, netName string, tags []string) {
+
+	for _, tag := range tags {
+		kind, value, found := strings.Cut(tag, ":")
+		if !found {
+			continue
+		}
+
+		var rr dns.RR
+		var err error
+
+		switch strings.ToLower(kind) {
+		case "cname":
+			alias := strings.ToLower(strings.TrimSpace(value))
+			if !strings.Contains(alias, ".") {
+				alias = alias + "." + strings.ToLower(netName)
+			}
+			rr = &dns.CNAME{Hdr: dns.RR_Header{Name: dns.Fqdn(alias), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: zoneDefaultTTL},
+				Target: dns.Fqdn(name),
+			}
+
+		case "srv":
+			rr, err = parseSRVTag(name, value)
+
+		case "txt":
+			rr = &dns.TXT{Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: zoneDefaultTTL},
+				Txt: []string{value},
+			}
+
+		case "rr":
+			rr, err = dns.NewRR(value)
+			if err == nil && rr == nil {
+				err = fmt.Errorf("empty record")
+			}
+
+		default:
+			continue
+		}
+
+		if err != nil {
+			log.Errorf("Invalid DNS tag on %s: %s (%v)", name, tag, err)
+			continue
+		}
+
+		// A peer's tags can only add records to its own network, or it
+		// could take over any name for everyone using this server
+		if !tagOwnerAllowed(rr.Header().Name, name, netName) {
+			log.Errorf("DNS tag on %s is outside %s, ignored: %s", name, netName, tag)
+			continue
+		}
+
+		z.Add(rr)
+	}
+}
+
+// tagOwnerAllowed returns true if a tag-sourced record's owner is the
+// peer's name in the network or is under the network's origin
+func tagOwnerAllowed(owner string, name string, netName string) bool {
+	if netName == "" {
+		return false
+	}
+	owner = strings.ToLower(dns.Fqdn(owner))
+	origin := strings.ToLower(dns.Fqdn(netName))
+	if owner == strings.ToLower(dns.Fqdn(name+"."+netName)) {
+		return true
+	}
+	return dns.IsSubDomain(origin, owner)
+}
+
+// parseSRVTag parses <_service._proto>:<port>[:<priority>:<weight>]
+func parseSRVTag(name string, value string) (dns.RR, error) {
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 && len(parts) != 4 {
+		return nil, fmt.Errorf("expected _service._proto:port[:priority:weight]")
+	}
+	if !strings.HasPrefix(parts[0], "_") {
+		return nil, fmt.Errorf("invalid service %s", parts[0])
+	}
+
+	numbers := []uint16{0, 0, 0}
+	for i, p := range parts[1:] {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = uint16(n)
+	}
+
+	return &dns.SRV{Hdr: dns.RR_Header{Name: dns.Fqdn(strings.ToLower(parts[0]) + "." + name), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: zoneDefaultTTL},
+		Port:     numbers[0],
+		Priority: numbers[1],
+		Weight:   numbers[2],
+		Target:   dns.Fqdn(name),
+	}, nil
+}
+
+// AddOrigin makes us authoritative for a network.  servers are the names
+// of the Nettica DNS servers in the network.
+func (z *Zone) AddOrigin(origin string, servers []string) {
+
+	origin = zoneKey(origin)
+	if origin == "" {
+		return
+	}
+	z.origins[origin] = true
+
+	mname := "ns." + origin
+	if len(servers) > 0 {
+		mname = servers[0]
+	}
+
+	z.Add(&dns.SOA{Hdr: dns.RR_Header{Name: dns.Fqdn(origin), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: zoneDefaultTTL},
+		Ns:      dns.Fqdn(strings.ToLower(mname)),
+		Mbox:    dns.Fqdn("hostmaster." + origin),
+		Refresh: zoneRefresh,
+		Retry:   zoneRetry,
+		Expire:  zoneExpire,
+		Minttl:  zoneNegative,
+	})
+
+	for _, server := range servers {
+		z.Add(&dns.NS{Hdr: dns.RR_Header{Name: dns.Fqdn(origin), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: zoneDefaultTTL},
+			Ns: dns.Fqdn(strings.ToLower(server)),
+		})
+	}
+}
+
+// Origin returns the closest network that name is in, or "" if we are not
+// authoritative for it
+func (z *Zone) Origin(name string) string {
+
+	if z == nil {
+		return ""
+	}
+
+	name = zoneKey(name)
+	for {
+		if z.origins[name] {
+			return name
+		}
+		_, parent, found := strings.Cut(name, ".")
+		if !found {
+			return ""
+		}
+		name = parent
+	}
+}
+
+// Origins returns the networks we are authoritative for
+func (z *Zone) Origins() []string {
+	origins := []string{}
+	for origin := range z.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// SOA returns the SOA record of a network
+func (z *Zone) SOA(origin string) *dns.SOA {
+	for _, rr := range z.records[zoneKey(origin)] {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// NegativeSOA returns the SOA for the authority section of an NXDOMAIN or
+// NODATA response.  Its TTL is the negative caching time (RFC 2308).
+func (z *Zone) NegativeSOA(origin string) dns.RR {
+	soa := z.SOA(origin)
+	if soa == nil {
+		return nil
+	}
+	rr := dns.Copy(soa)
+	if soa.Minttl < rr.Header().Ttl {
+		rr.Header().Ttl = soa.Minttl
+	}
+	return rr
+}
+
+// Exists returns true if name has records or is an empty non-terminal, that
+// is a name with records below it
+func (z *Zone) Exists(name string) bool {
+	key := zoneKey(name)
+	if _, found := z.records[key]; found {
+		return true
+	}
+	suffix := "." + key
+	for k := range z.records {
+		if strings.HasSuffix(k, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// inOrigin returns true if a zone key belongs to a network and not to a
+// more specific one
+func (z *Zone) inOrigin(key string, origin string) bool {
+	return z.Origin(key) == origin
+}
+
+// Records returns every record in a network other than the SOA, sorted
+func (z *Zone) Records(origin string) []dns.RR {
+	origin = zoneKey(origin)
+	keys := []string{}
+	for key := range z.records {
+		if z.inOrigin(key, origin) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := []dns.RR{}
+	for _, key := range keys {
+		for _, rr := range z.records[key] {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				result = append(result, dns.Copy(rr))
+			}
+		}
+	}
+	return result
+}
+
+// Transfer returns a network's records as an AXFR: the SOA, every other
+// record, then the SOA again
+func (z *Zone) Transfer(origin string) []dns.RR {
+	soa := z.SOA(origin)
+	if soa == nil {
+		return nil
+	}
+	result := []dns.RR{dns.Copy(soa)}
+	result = append(result, z.Records(origin)...)
+	result = append(result, dns.Copy(soa))
+	return result
+}
+
+// Fingerprint returns a hash of a network's records, excluding the SOA, so
+// the serial only changes when the contents do
+func (z *Zone) Fingerprint(origin string) string {
+	lines := []string{}
+	for _, rr := range z.Records(origin) {
+		lines = append(lines, rr.String())
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Equal returns true if two zones have the same origins and records,
+// not counting the SOA serials
+func (z *Zone) Equal(other *Zone) bool {
+	if z == nil || other == nil {
+		return z == other
+	}
+	if len(z.origins) != len(other.origins) || len(z.records) != len(other.records) {
+		return false
+	}
+	for origin := range z.origins {
+		if !other.origins[origin] {
+			return false
+		}
+	}
+	return z.contents() == other.contents()
+}
+
+// contents returns every record other than the SOAs, sorted
+func (z *Zone) contents() string {
+	lines := []string{}
+	for _, rrs := range z.records {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				lines = append(lines, rr.String())
+			}
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// UpdateSerials sets the serial of each network, keeping the previous
+// serial if nothing has changed since the last zone
+func (z *Zone) UpdateSerials(previous *Zone) {
+	now := uint32(time.Now().Unix())
+	for origin := range z.origins {
+		soa := z.SOA(origin)
+		if soa == nil {
+			continue
+		}
+		soa.Serial = now
+		if previous == nil {
+			continue
+		}
+		old := previous.SOA(origin)
+		if old == nil {
+			continue
+		}
+		if previous.Fingerprint(origin) == z.Fingerprint(origin) {
+			soa.Serial = old.Serial
+		} else if soa.Serial <= old.Serial {
+			soa.Serial = old.Serial + 1
+		}
+	}
+}
+
+// Merge adds every record from another zone
+func (z *Zone) Merge(other *Zone) {
+	for origin := range other.origins {
+		z.origins[origin] = true
+	}
+	for _, rrs := range other.records {
+		for _, rr := range rrs {
+			z.Add(rr)
+		}
+	}
+}
+
+// Len returns the number of names in the zone
+func (z *Zone) Len() int {
+	if z == nil {
+		return 0
+	}
+	return len(z.records)
+}
+
+// Has returns true if the zone has any records for name
+func (z *Zone) Has(name string) bool {
+	_, found := z.records[zoneKey(name)]
+	return found
+}
+
+// records of a type at a name, copied so they can be modified
+func (z *Zone) get(name string, qtype uint16) []dns.RR {
+	result := []dns.RR{}
+	for _, rr := range z.records[zoneKey(name)] {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			result = append(result, dns.Copy(rr))
+		}
+	}
+	return result
+}
+
+// Answer builds the answer to a question from the zone, following CNAMEs
+// within the zone.  A/AAAA answers are rotated so clients spread their
+// connections across multiple addresses.  It returns false if the zone
+// has no records for the name.
+func (z *Zone) Answer(q dns.Question) ([]dns.RR, []dns.RR, bool) {
+
+	if !z.Has(q.Name) {
+		return nil, nil, false
+	}
+
+	answer := []dns.RR{}
+	name := q.Name
+
+	for hops := 0; hops < zoneMaxCNAME; hops++ {
+		rrs := z.get(name, q.Qtype)
+		if len(rrs) > 0 {
+			if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+				offset := rand.Intn(len(rrs))
+				rrs = append(rrs[offset:], rrs[:offset]...)
+			}
+			// the first name answered keeps the case of the question
+			if hops == 0 {
+				for _, rr := range rrs {
+					rr.Header().Name = q.Name
+				}
+			}
+			answer = append(answer, rrs...)
+			break
+		}
+
+		if q.Qtype == dns.TypeCNAME {
+			break
+		}
+		cnames := z.get(name, dns.TypeCNAME)
+		if len(cnames) == 0 {
+			break
+		}
+		if hops == 0 {
+			cnames[0].Header().Name = q.Name
+		}
+		answer = append(answer, cnames[0])
+		name = cnames[0].(*dns.CNAME).Target
+		if !z.Has(name) {
+			break
+		}
+	}
+
+	// Include the addresses of SRV targets we know about
+	extra := []dns.RR{}
+	for _, rr := range answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			extra = append(extra, z.get(srv.Target, dns.TypeA)...)
+			extra = append(extra, z.get(srv.Target, dns.TypeAAAA)...)
+		}
+	}
+
+	return answer, extra, true
+}